@@ -2,40 +2,13 @@ package ast
 
 import (
 	"fmt"
-	"log"
 	"reflect"
 	"regexp"
-	"runtime"
 	"strconv"
 	"strings"
 	"unicode"
-
-	"github.com/dianelooney/directive/eval"
 )
 
-var logitI = 0
-
-const loggingEnabled = false
-
-func logit() func() {
-	if !loggingEnabled {
-		return func() {}
-	}
-
-	pc, _, _, _ := runtime.Caller(1)
-	f := runtime.FuncForPC(pc)
-	path := f.Name()
-	split := strings.Split(path, "/")
-	s := split[len(split)-1]
-
-	fmt.Printf("%s+%s\n", strings.Repeat("\t", logitI), s)
-	logitI++
-	return func() {
-		logitI--
-		fmt.Printf("%s-%s\n", strings.Repeat("\t", logitI), s)
-	}
-}
-
 type Token uint8
 
 const (
@@ -52,10 +25,22 @@ const (
 	COMMA
 )
 
+// Position is a location in the parsed source. Byte is a zero-based
+// offset, Line and Column are one-based and Column counts bytes. Filename
+// is set for sources parsed with NewFileParser.
 type Position struct {
-	Byte   int
-	Line   int
-	Column int
+	Filename string `json:",omitempty"`
+	Byte     int
+	Line     int
+	Column   int
+}
+
+// String renders p as "line:col", or "file:line:col" with a Filename.
+func (p Position) String() string {
+	if p.Filename != "" {
+		return fmt.Sprintf("%s:%d:%d", p.Filename, p.Line, p.Column)
+	}
+	return fmt.Sprintf("%d:%d", p.Line, p.Column)
 }
 
 type Node interface {
@@ -109,13 +94,7 @@ func (d Document) String() string {
 }
 
 func (d Document) Execute(x interface{}) error {
-	for _, dir := range d.Directives {
-		err := dir.Execute(x)
-		if err != nil {
-			return err
-		}
-	}
-	return nil
+	return execute(&d, x)
 }
 
 type Object struct {
@@ -163,48 +142,32 @@ func (n Number) String() string {
 type Directive struct {
 	node
 	Identifier string
-	IsContext  bool
-	Value      Node
-	HasSemi    bool
+	// Label is an optional second identifier naming a block, as in
+	// `Block Kit { ... }`. Only parsers made with Labeled accept it.
+	Label     string
+	IsContext bool
+	Value     Node
+	HasSemi   bool
 }
 
 func (d Directive) String() string {
+	ident := d.Identifier
+	if d.Label != "" {
+		ident += " " + d.Label
+	}
 	if d.IsContext {
-		return fmt.Sprintf("@%s %s;", d.Identifier, d.Value)
+		return fmt.Sprintf("@%s %s;", ident, d.Value)
 	} else {
-		return fmt.Sprintf("%s %s;", d.Identifier, d.Value)
+		return fmt.Sprintf("%s %s;", ident, d.Value)
 	}
 }
 
 func (d Directive) Execute(x interface{}) error {
-	switch v := d.Value.(type) {
-	case *Object:
-		y, err := get(x, d.Identifier)
-		if err != nil {
-			return err
-		}
-		return v.Execute(y)
-	case *String:
-		return set(x, d.Identifier, v.Value)
-	case *Number:
-		return set(x, d.Identifier, v.Value)
-	case *Note:
-		return set(x, d.Identifier, v.Value)
-	case *Unknown:
-		return set(x, d.Identifier, v.Value)
-	}
-	log.Fatalf("Unhandled value type %T", d.Value)
-	panic("unreachable")
+	return execute(&d, x)
 }
 
 func (o Object) Execute(x interface{}) error {
-	for _, dir := range o.Directives {
-		err := dir.Execute(x)
-		if err != nil {
-			return err
-		}
-	}
-	return nil
+	return execute(&o, x)
 }
 
 type RepeatedDirective struct {
@@ -214,63 +177,8 @@ type RepeatedDirective struct {
 	Values     []Node
 }
 
-func (r RepeatedDirective) Execute(x interface{}) (err error) {
-	defer func() {
-		e := recover()
-		if err == nil && e != nil {
-			err = fmt.Errorf("Recovered from panic: %v", e)
-		}
-	}()
-
-	for _, value := range r.Values {
-		switch v := value.(type) {
-		case *Object:
-			y, err := get(x, r.Identifier)
-			if err != nil {
-				return err
-			}
-			v.Execute(y)
-			continue
-		case *String:
-			if v.IsMacro {
-				nums := eval.Eval(v.Value)
-				for _, n := range nums {
-					err := set(x, r.Identifier, fmt.Sprintf("%v", n))
-					if err != nil {
-						return err
-					}
-				}
-			} else {
-				err := set(x, r.Identifier, v.Value)
-				if err != nil {
-					return err
-				}
-			}
-			continue
-		case *Number:
-			err := set(x, r.Identifier, v.Value)
-			if err != nil {
-				return err
-			}
-			continue
-		case *Note:
-			err := set(x, r.Identifier, v.Value)
-			if err != nil {
-				return err
-			}
-			continue
-		case *Unknown:
-			err := set(x, r.Identifier, v.Value)
-			if err != nil {
-				return err
-			}
-			continue
-		default:
-			log.Fatalf("Unhandled value type %T", v)
-		}
-		panic("unreachable")
-	}
-	return nil
+func (r RepeatedDirective) Execute(x interface{}) error {
+	return execute(&r, x)
 }
 
 func (d RepeatedDirective) String() string {
@@ -287,15 +195,36 @@ func (d RepeatedDirective) String() string {
 }
 
 type Parser struct {
-	data []byte
+	data   []byte
+	pos    Position
+	labels bool
 }
 
 func NewParser(data []byte) *Parser {
 	return &Parser{
 		data: data,
+		pos:  Position{Line: 1, Column: 1},
 	}
 }
 
+// NewFileParser is like NewParser, but the positions of the parsed nodes,
+// and the errors of executing them, name filename.
+func NewFileParser(filename string, data []byte) *Parser {
+	p := NewParser(data)
+	p.pos.Filename = filename
+	return p
+}
+
+// Labeled makes p accept the extended syntax of languages built on
+// directives, such as schemas: a label between the identifier and the
+// block of a directive, as in `Block Kit { ... }`, and bare words as
+// string values, as in `Required true`. Documents that are executed have
+// no use for either, so other parsers reject them.
+func (p *Parser) Labeled() *Parser {
+	p.labels = true
+	return p
+}
+
 func (p *Parser) Parse() (Node, error) {
 	return p.parseDocument()
 }
@@ -320,11 +249,29 @@ func (p *Parser) consumeByte(b byte) error {
 		return fmt.Errorf("expected byte '%v'", b)
 	}
 
-	p.data = p.data[1:]
+	p.advance(1)
 
 	return nil
 }
 
+// advance consumes n bytes, keeping track of the current position.
+func (p *Parser) advance(n int) {
+	for _, c := range p.data[:n] {
+		p.pos.Byte++
+		if c == '\n' {
+			p.pos.Line++
+			p.pos.Column = 1
+		} else {
+			p.pos.Column++
+		}
+	}
+	p.data = p.data[n:]
+}
+
+func (p *Parser) span(begin Position, text string) node {
+	return node{begin: begin, end: p.pos, text: []byte(text)}
+}
+
 func (p *Parser) consumeRegex(r *regexp.Regexp) (text string, err error) {
 	s := r.FindSubmatch(p.data)
 	if s == nil {
@@ -332,7 +279,7 @@ func (p *Parser) consumeRegex(r *regexp.Regexp) (text string, err error) {
 	}
 
 	text = string(s[0])
-	p.data = p.data[len(text):]
+	p.advance(len(text))
 
 	return
 }
@@ -349,7 +296,7 @@ func (p *Parser) skipWhitespace() (n []Node) {
 		}
 		if c == '\n' {
 			if !firstNewline {
-				n = append(n, Whitespace{})
+				n = append(n, Whitespace{node{begin: p.pos, end: p.pos}})
 			}
 			firstNewline = false
 		}
@@ -371,14 +318,14 @@ func (p *Parser) skipComma() {
 }
 
 func (p *Parser) parseDocument() (d *Document, err error) {
-	defer logit()()
-
 	d = &Document{}
+	d.begin = p.pos
 	for {
 		d.Directives = append(d.Directives, p.skipWhitespace()...)
 
 		c, ok := p.peekByte()
 		if !ok {
+			d.end = p.pos
 			return
 		}
 
@@ -399,9 +346,8 @@ func (p *Parser) parseDocument() (d *Document, err error) {
 }
 
 func (p *Parser) parseDirective() (d *Directive, err error) {
-	defer logit()()
-
 	d = &Directive{}
+	d.begin = p.pos
 	c, ok := p.peekByte()
 	if !ok {
 		return nil, fmt.Errorf("encountered EOF while parsing Directive")
@@ -421,23 +367,43 @@ func (p *Parser) parseDirective() (d *Directive, err error) {
 
 	p.skipWhitespace()
 
-	d.Value, err = p.parseValue()
+	if c, ok := p.peekByte(); ok && p.labels && unicode.IsLetter(rune(c)) {
+		word, err := p.parseWord()
+		if err != nil {
+			return nil, err
+		}
+		d.end = p.pos
+		p.skipWhitespace()
+		if c, ok := p.peekByte(); ok && c == '{' {
+			d.Label = word.Value
+		} else {
+			d.Value = word
+		}
+	}
+
+	if d.Value == nil {
+		d.Value, err = p.parseValue()
+		d.end = p.pos
+	}
 
 	p.skipWhitespace()
 	if b, ok := p.peekByte(); ok && b == ';' {
 		p.consumeByte(';')
 		d.HasSemi = true
+		d.end = p.pos
 	}
 
 	return d, err
 }
 
 func (p *Parser) parseRepeatedDirective() (d *RepeatedDirective, err error) {
+	begin := p.pos
 	err = p.consumeByte('[')
 	if err != nil {
 		return nil, fmt.Errorf("could not parse RepeatedDirective: %v", err)
 	}
 	d = &RepeatedDirective{}
+	d.begin = begin
 
 	if c, ok := p.peekByte(); !ok {
 		return nil, fmt.Errorf("encountered EOF while parsing RepeatedDirective")
@@ -474,6 +440,7 @@ func (p *Parser) parseRepeatedDirective() (d *RepeatedDirective, err error) {
 			break
 		}
 	}
+	d.end = p.pos
 	p.skipSemi()
 	return d, nil
 }
@@ -481,8 +448,6 @@ func (p *Parser) parseRepeatedDirective() (d *RepeatedDirective, err error) {
 var identifier = regexp.MustCompile(`^[a-zA-Z][a-zA-Z0-9_]*`)
 
 func (p *Parser) parseIdentifier() (ident string, err error) {
-	defer logit()()
-
 	ident, err = p.consumeRegex(identifier)
 	if err != nil {
 		err = fmt.Errorf("Unable to parse identifier: %v, but it was '%s'", err, p.data[:10])
@@ -503,7 +468,6 @@ var strSgl = regexp.MustCompile(`'((?:[^"\\]|\\.)*)'`)
 var strMacro = regexp.MustCompile("`" + `([^` + "`" + `]*)` + "`")
 
 func (p *Parser) parseValue() (v Node, err error) {
-	defer logit()()
 	c, ok := p.peekByte()
 
 	if !ok {
@@ -536,13 +500,24 @@ func (p *Parser) parseValue() (v Node, err error) {
 			return nil, fmt.Errorf("failed to parse Unknown: %v", err)
 		}
 		return n, nil
+	} else if p.labels && unicode.IsLetter(rune(c)) {
+		return p.parseWord()
 	}
 	return nil, fmt.Errorf("failed to parse Value: unrecognized character %s", []byte{c})
 }
 
-func (p *Parser) parseString() (s *String, err error) {
-	defer logit()()
+// parseWord parses a bare word, which a Labeled parser reads as a string.
+func (p *Parser) parseWord() (s *String, err error) {
+	begin := p.pos
+	v, err := p.parseIdentifier()
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse Value: %v", err)
+	}
+	return &String{Value: v, node: p.span(begin, v)}, nil
+}
 
+func (p *Parser) parseString() (s *String, err error) {
+	begin := p.pos
 	c, ok := p.peekByte()
 	if !ok {
 		return nil, fmt.Errorf("encountered EOF while parsing Value")
@@ -557,7 +532,7 @@ func (p *Parser) parseString() (s *String, err error) {
 		if err != nil {
 			return nil, err
 		}
-		return &String{Value: v, node: node{text: []byte(s)}}, nil
+		return &String{Value: v, node: p.span(begin, s)}, nil
 	}
 
 	if c == '\'' {
@@ -569,7 +544,7 @@ func (p *Parser) parseString() (s *String, err error) {
 		if err != nil {
 			return nil, err
 		}
-		return &String{Value: v, node: node{text: []byte(s)}}, nil
+		return &String{Value: v, node: p.span(begin, s)}, nil
 	}
 
 	if c == '`' {
@@ -581,7 +556,7 @@ func (p *Parser) parseString() (s *String, err error) {
 		if err != nil {
 			return nil, err
 		}
-		return &String{Value: v, node: node{text: []byte(s)}, IsMacro: true}, nil
+		return &String{Value: v, node: p.span(begin, s), IsMacro: true}, nil
 	}
 
 	p.consumeByte(c)
@@ -589,8 +564,10 @@ func (p *Parser) parseString() (s *String, err error) {
 }
 
 func (p *Parser) parseObject() (o *Object, err error) {
+	begin := p.pos
 	p.consumeByte('{')
 	o = &Object{}
+	o.begin = begin
 	for {
 		o.Directives = append(o.Directives, p.skipWhitespace()...)
 
@@ -598,6 +575,7 @@ func (p *Parser) parseObject() (o *Object, err error) {
 			return nil, fmt.Errorf("encountered EOF while parsing Object")
 		} else if c == '}' {
 			p.consumeByte('}')
+			o.end = p.pos
 			return o, nil
 		} else if c == '[' {
 			v, err := p.parseRepeatedDirective()
@@ -615,18 +593,24 @@ func (p *Parser) parseObject() (o *Object, err error) {
 	}
 }
 
-var number = regexp.MustCompile(`^([+-]?)[0-9]+(?:\.[0-9]*)\b?`)
+var number = regexp.MustCompile(`^[+-]?[0-9]+(?:\.[0-9]*)?`)
 
 func (p *Parser) parseNumber() (n *Number, err error) {
-	defer logit()()
-
+	loc := number.FindIndex(p.data)
+	if loc == nil {
+		return nil, fmt.Errorf("Number was not formatted correctly: expected to match regex '%s'", number)
+	}
+	if rest := p.data[loc[1]:]; len(rest) > 0 && (rest[0] == '#' || rest[0] == '_' || unicode.IsLetter(rune(rest[0]))) {
+		return nil, fmt.Errorf("Number was not formatted correctly: unexpected '%c' after '%s'", rest[0], p.data[:loc[1]])
+	}
+	begin := p.pos
 	num, err := p.consumeRegex(number)
 	if err != nil {
 		return nil, fmt.Errorf("Number was not formatted correctly: %v", err)
 	}
 	n = &Number{
 		Value: num,
-		node:  node{text: []byte(num)},
+		node:  p.span(begin, num),
 	}
 
 	return n, nil
@@ -635,15 +619,14 @@ func (p *Parser) parseNumber() (n *Number, err error) {
 var note = regexp.MustCompile(`^([+-]?[0-9]+[#b]*)\b`)
 
 func (p *Parser) parseNote() (n *Note, err error) {
-	defer logit()()
-
+	begin := p.pos
 	v, err := p.consumeRegex(note)
 	if err != nil {
 		return nil, fmt.Errorf("Note was not formatted correctly: %v", err)
 	}
 	n = &Note{
 		Value: v,
-		node:  node{text: []byte(v)},
+		node:  p.span(begin, v),
 	}
 
 	return n, nil
@@ -652,15 +635,14 @@ func (p *Parser) parseNote() (n *Note, err error) {
 var unknown = regexp.MustCompile(`^(\?)`)
 
 func (p *Parser) parseUnknown() (n *Unknown, err error) {
-	defer logit()()
-
+	begin := p.pos
 	v, err := p.consumeRegex(unknown)
 	if err != nil {
 		return nil, fmt.Errorf("Unknown was not formatted correctly: %v", err)
 	}
 	n = &Unknown{
 		Value: v,
-		node:  node{text: []byte(v)},
+		node:  p.span(begin, v),
 	}
 
 	return n, nil
@@ -668,74 +650,89 @@ func (p *Parser) parseUnknown() (n *Unknown, err error) {
 
 func get(x interface{}, field string) (interface{}, error) {
 	t := reflect.ValueOf(x)
-	m := t.MethodByName(field)
-	if m.IsValid() && !m.IsNil() {
-		out := m.Call(nil)
+	m, ok := lookup(t.Type(), field)
+	if ok && m.Kind == getterMethod {
+		out := t.Method(m.Index[0]).Call(nil)
 		return out[0].Interface(), nil
 	}
 
-	f := t.FieldByName(field)
-	if !f.IsNil() {
-		return f.Interface(), nil
+	if ok && m.Kind == objectField && t.Kind() == reflect.Ptr {
+		f := fieldOf(t, m.Index)
+		switch f.Kind() {
+		case reflect.Ptr:
+			if f.IsNil() {
+				f.Set(reflect.New(f.Type().Elem()))
+			}
+			return f.Interface(), nil
+		case reflect.Interface:
+			if !f.IsNil() {
+				return f.Interface(), nil
+			}
+		case reflect.Struct:
+			return f.Addr().Interface(), nil
+		}
 	}
 
 	return nil, fmt.Errorf("%T did not have method or field %s", x, field)
 }
 
 func set(x interface{}, field string, value string) error {
-	t := reflect.ValueOf(x)
+	t, m, v, err := prepareSet(x, field, value)
+	if err != nil {
+		return err
+	}
+	applySet(t, m, v)
+	return nil
+}
 
-	m := t.MethodByName(field)
-	if k := m.Kind(); k == reflect.Func {
-		if m.Type().NumIn() == 0 {
-			fmt.Printf("Calling %s.%s, but ignored arguments\n", t.Type().Name(), m.Type().Name())
-			return nil
-		}
-		t := m.Type().In(0)
-		switch t.Kind() {
-		case reflect.Float64:
-			v, err := strconv.ParseFloat(value, 64)
-			if err != nil {
-				return fmt.Errorf("error while calling method %s with '%s': %v", field, value, err)
-			}
-			m.Call([]reflect.Value{reflect.ValueOf(v)})
-		case reflect.String:
-			m.Call([]reflect.Value{reflect.ValueOf(value)})
-		case reflect.Int:
-			v, err := strconv.ParseInt(value, 10, 32)
-			if err != nil {
-				return fmt.Errorf("error while calling method %s with '%s': %v", field, value, err)
-			}
-			m.Call([]reflect.Value{reflect.ValueOf(int(v))})
-		default:
-			log.Fatalf("Need to implement kind '%s' in directive/ast.set - method", t.Kind())
-		}
-		return nil
+// prepareSet resolves field on x and converts value for it without
+// changing x.
+func prepareSet(x interface{}, field string, value string) (t reflect.Value, m member, v reflect.Value, err error) {
+	t, m, err = resolveSet(x, field)
+	if err != nil {
+		return t, m, v, err
 	}
+	v, err = convertSet(m, field, value)
+	return t, m, v, err
+}
 
-	f := t.Elem().FieldByName(field)
-	zero := reflect.Value{}
-	if f != zero {
-		switch f.Kind() {
-		case reflect.String:
-			f.Set(reflect.ValueOf(value))
-		case reflect.Int:
-			v, err := strconv.Atoi(value)
-			if err != nil {
-				return fmt.Errorf("error while setting field %s to '%s': %v", field, value, err)
-			}
-			f.Set(reflect.ValueOf(v))
-		case reflect.Float64:
-			v, err := strconv.ParseFloat(value, 64)
-			if err != nil {
-				return fmt.Errorf("error while setting field %s to '%s': %v", field, value, err)
-			}
-			f.Set(reflect.ValueOf(v))
-		default:
-			log.Fatalf("Need to implement kind '%s' in directive/ast.set - field", f.Kind())
-		}
-		return nil
+func resolveSet(x interface{}, field string) (t reflect.Value, m member, err error) {
+	t = reflect.ValueOf(x)
+	m, ok := lookup(t.Type(), field)
+	if !ok || m.Kind == getterMethod || m.Kind == objectField {
+		return t, m, fmt.Errorf("%T did not have method or field %s", x, field)
 	}
+	if m.Kind != setterMethod && t.Kind() != reflect.Ptr {
+		return t, m, fmt.Errorf("%T is not a pointer, cannot set field %s", x, field)
+	}
+	return t, m, nil
+}
 
-	return fmt.Errorf("%T did not have method or field %s", x, field)
+func convertSet(m member, field string, value string) (v reflect.Value, err error) {
+	if m.Type == nil {
+		return v, nil
+	}
+	v, err = convert(value, m.Type)
+	if err != nil && m.Kind == setterMethod {
+		return v, fmt.Errorf("error while calling method %s with '%s': %w", field, value, err)
+	}
+	if err != nil {
+		return v, fmt.Errorf("error while setting field %s to '%s': %w", field, value, err)
+	}
+	return v, nil
+}
+
+func applySet(t reflect.Value, m member, v reflect.Value) {
+	switch m.Kind {
+	case setterMethod:
+		if !v.IsValid() {
+			return
+		}
+		t.Method(m.Index[0]).Call([]reflect.Value{v})
+	case sliceField:
+		f := fieldOf(t, m.Index)
+		f.Set(reflect.Append(f, v))
+	default:
+		fieldOf(t, m.Index).Set(v)
+	}
 }
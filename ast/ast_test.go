@@ -1,6 +1,11 @@
 package ast_test
 
-import "testing"
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"testing"
+)
 
 import . "github.com/dianelooney/directive/ast"
 
@@ -84,3 +89,398 @@ func TestParseDocument(t *testing.T) {
 		t.Errorf("Parse returned an incorrect string argument. Expected '4/4' but got '%v'", document.Time)
 	}
 }
+
+func TestParseNumbers(t *testing.T) {
+	d, err := NewParser([]byte("A 120\nB -3\nC +4\nD 1.5\nE 2.\nF 3b\nG 5bb\n")).Parse()
+	if err != nil {
+		t.Fatalf("Parse returned an error: %v", err)
+	}
+
+	expected := []string{"*ast.Number 120", "*ast.Number -3", "*ast.Number +4", "*ast.Number 1.5", "*ast.Number 2.", "*ast.Note 3b", "*ast.Note 5bb"}
+	for i, n := range d.(*Document).Directives {
+		var actual string
+		switch v := n.(*Directive).Value.(type) {
+		case *Number:
+			actual = fmt.Sprintf("%T %s", v, v.Value)
+		case *Note:
+			actual = fmt.Sprintf("%T %s", v, v.Value)
+		default:
+			actual = fmt.Sprintf("%T", v)
+		}
+		if actual != expected[i] {
+			t.Errorf("Expected %s but got %s", expected[i], actual)
+		}
+	}
+}
+
+func TestParseLabeled(t *testing.T) {
+	const doc = `Block Kit { Required true }`
+	if _, err := NewParser([]byte(doc)).Parse(); err == nil {
+		t.Errorf("Expected Parse to reject a label without Labeled")
+	}
+
+	d, err := NewParser([]byte(doc)).Labeled().Parse()
+	if err != nil {
+		t.Fatalf("Parse returned an error: %v", err)
+	}
+	block := d.(*Document).Directives[0].(*Directive)
+	if block.Label != "Kit" {
+		t.Errorf("Expected label Kit but got %q", block.Label)
+	}
+	required := block.Value.(*Object).Directives[0].(*Directive)
+	if s, ok := required.Value.(*String); !ok || s.Value != "true" || required.Label != "" {
+		t.Errorf("Expected the bare word true as a string value but got %#v", required)
+	}
+}
+
+func TestCompile_LongMacro(t *testing.T) {
+	for _, c := range []struct {
+		macro  string
+		n      int
+		cached int
+	}{
+		{"`0 * 10`", 10, 10},
+		{fmt.Sprintf("`0 * %d`", MaxCachedMacro+1), MaxCachedMacro + 1, 0},
+	} {
+		d, err := NewParser([]byte("[Pulse " + c.macro + "]")).Parse()
+		if err != nil {
+			t.Fatalf("Parse returned an error: %v", err)
+		}
+		p := Compile(d)
+		for i := 0; i < 2; i++ {
+			m := Measure{}
+			if err := p.Execute(&m, Options{}); err != nil {
+				t.Fatalf("Execute returned an error: %v", err)
+			}
+			if len(m.Pulses) != c.n {
+				t.Errorf("%s: expected %d pulses but got %d", c.macro, c.n, len(m.Pulses))
+			}
+		}
+		if n := CachedMacroValues(p); n != c.cached {
+			t.Errorf("%s: expected the program to keep %d values but it kept %d", c.macro, c.cached, n)
+		}
+	}
+}
+
+type Instrument interface {
+	Kind() string
+}
+
+type Wave struct {
+	Pattern string
+}
+
+func (w *Wave) Kind() string { return "wave" }
+
+type Drums struct {
+	Sample string
+}
+
+func (d *Drums) Kind() string { return "drums" }
+
+type Song struct {
+	Tempo       float64
+	Instruments []Instrument
+}
+
+type Patch struct {
+	ByKind map[string]Instrument
+}
+
+type Rack struct {
+	ByKind map[string][]Instrument
+}
+
+type Pad struct {
+	Pattern string
+}
+
+func (p *Pad) Kind() string { return "pad" }
+
+// pads counts the calls of the RegPad factory.
+var pads int
+
+func init() {
+	Register("RegWave", func() Instrument { return &Wave{} })
+	Register("RegDrums", func() Instrument { return &Drums{} })
+	Register("RegPad", func() *Pad { pads++; return &Pad{} })
+}
+
+func TestRegister(t *testing.T) {
+	const doc = `
+	Tempo 120
+	RegWave { Pattern "sin" }
+	RegDrums { Sample "808s_2" }
+	[RegWave { Pattern "saw" }]
+	`
+
+	d, err := NewParser([]byte(doc)).Parse()
+	if err != nil {
+		t.Fatalf("Parse returned an error: %v", err)
+	}
+
+	song := Song{}
+	err = d.Execute(&song)
+	if err != nil {
+		t.Fatalf("Execute returned an error: %v", err)
+	}
+	if len(song.Instruments) != 3 {
+		t.Fatalf("Expected 3 instruments but got %d", len(song.Instruments))
+	}
+	if w, ok := song.Instruments[2].(*Wave); !ok || w.Pattern != "saw" {
+		t.Errorf("Expected the third instrument to be a saw wave but got %#v", song.Instruments[2])
+	}
+	if d, ok := song.Instruments[1].(*Drums); !ok || d.Sample != "808s_2" {
+		t.Errorf("Expected the second instrument to be drums but got %#v", song.Instruments[1])
+	}
+}
+
+func TestRegister_Map(t *testing.T) {
+	d, err := NewParser([]byte(`RegWave { Pattern "sin" } RegDrums { Sample "808s_2" }`)).Parse()
+	if err != nil {
+		t.Fatalf("Parse returned an error: %v", err)
+	}
+
+	patch := Patch{}
+	if err := d.Execute(&patch); err != nil {
+		t.Fatalf("Execute returned an error: %v", err)
+	}
+	if w, ok := patch.ByKind["RegWave"].(*Wave); !ok || w.Pattern != "sin" {
+		t.Errorf("Expected a sine wave for RegWave but got %#v", patch.ByKind["RegWave"])
+	}
+	if d, ok := patch.ByKind["RegDrums"].(*Drums); !ok || d.Sample != "808s_2" {
+		t.Errorf("Expected drums for RegDrums but got %#v", patch.ByKind["RegDrums"])
+	}
+
+	d, err = NewParser([]byte(`RegWave { Pattern "sin" } RegWave { Pattern "saw" }`)).Parse()
+	if err != nil {
+		t.Fatalf("Parse returned an error: %v", err)
+	}
+	err = d.Execute(&Patch{})
+	const expected = "1:35: RegWave[1]: *ast_test.Patch.ByKind already holds a block of kind RegWave"
+	if err == nil || err.Error() != expected {
+		t.Errorf("Expected error %q but got %v", expected, err)
+	}
+
+	rack := Rack{}
+	if err := d.Execute(&rack); err != nil {
+		t.Fatalf("Execute returned an error: %v", err)
+	}
+	waves := rack.ByKind["RegWave"]
+	if len(waves) != 2 || waves[0].(*Wave).Pattern != "sin" || waves[1].(*Wave).Pattern != "saw" {
+		t.Errorf("Expected a sine and a saw wave but got %#v", waves)
+	}
+}
+
+func TestRegister_Unknown(t *testing.T) {
+	d, err := NewParser([]byte(`RegSynth { Pattern "sin" }`)).Parse()
+	if err != nil {
+		t.Fatalf("Parse returned an error: %v", err)
+	}
+
+	err = d.Execute(&Song{})
+	const expected = "1:10: RegSynth: unknown block kind RegSynth for *ast_test.Song; registered kinds: RegDrums, RegPad, RegWave"
+	if err == nil || err.Error() != expected {
+		t.Errorf("Expected error %q but got %v", expected, err)
+	}
+}
+
+func TestRegister_Validate(t *testing.T) {
+	d, err := NewParser([]byte(`RegPad { Pattrn "sin" } RegWave { Pattrn "saw" }`)).Parse()
+	if err != nil {
+		t.Fatalf("Parse returned an error: %v", err)
+	}
+
+	diags := Validate(d, reflect.TypeOf(&Song{}))
+	const expected = "1:10: RegPad.Pattrn: unknown directive Pattrn for *ast_test.Pad; did you mean Pattern?"
+	if len(diags) != 1 || diags[0].Error() != expected {
+		t.Errorf("Expected diagnostic %q but got %v", expected, diags)
+	}
+	if pads != 0 {
+		t.Errorf("Expected Validate not to call the factory, but it was called %d times", pads)
+	}
+}
+
+type Synth struct {
+	Tempo   float64 `directive:",required"`
+	Volume  float64 `default:"0.5" validate:"min=0,max=1"`
+	Pattern string  `validate:"oneof=sin square saw"`
+	Voices  *Voices
+}
+
+type Voices struct {
+	Count int `directive:"Voices,required" validate:"min=1"`
+}
+
+func TestExecute_Tags(t *testing.T) {
+	d, err := NewParser([]byte("Pattern \"tri\"\nVoices { Voices 0 }\n")).Parse()
+	if err != nil {
+		t.Fatalf("Parse returned an error: %v", err)
+	}
+
+	synth := Synth{}
+	err = d.Execute(&synth)
+	const expected = "1:1: missing required directive Tempo\n" +
+		"1:1: Pattern: Pattern must be one of sin, square, saw, got tri\n" +
+		"2:10: Voices.Voices: Voices must be at least 1, got 0"
+	if err == nil || err.Error() != expected {
+		t.Errorf("Expected error:\n%s\nbut got:\n%v", expected, err)
+	}
+	if synth.Volume != 0.5 {
+		t.Errorf("Expected the default volume 0.5 but got %v", synth.Volume)
+	}
+
+	d, err = NewParser([]byte("Tempo 120")).Parse()
+	if err != nil {
+		t.Fatalf("Parse returned an error: %v", err)
+	}
+	var lerr *LimitError
+	err = ExecuteWith(d, &Synth{}, Options{Limits: Limits{MaxSets: 1}})
+	if !errors.As(err, &lerr) || lerr.Limit != LimitSets {
+		t.Errorf("Expected a set limit error from the default volume but got %v", err)
+	}
+}
+
+type Bar struct {
+	Pulses []float64
+	Length float64
+	begun  []string
+}
+
+func (b *Bar) Pulse(t float64) {
+	b.Pulses = append(b.Pulses, t)
+}
+
+func (b *Bar) BeginDirective(name string) error {
+	b.begun = append(b.begun, name)
+	return nil
+}
+
+func (b *Bar) EndObject() error {
+	for _, p := range b.Pulses {
+		if p > b.Length {
+			b.Length = p
+		}
+	}
+	return nil
+}
+
+func (b *Bar) Validate() error {
+	if b.Length > 4 {
+		return fmt.Errorf("pulse %v is past the end of the bar", b.Length)
+	}
+	return nil
+}
+
+type Score struct {
+	Bars []*Bar
+}
+
+func (s *Score) Bar() *Bar {
+	b := &Bar{}
+	s.Bars = append(s.Bars, b)
+	return b
+}
+
+func TestExecute_Hooks(t *testing.T) {
+	d, err := NewParser([]byte("Bar { [Pulse 1 3] }\nBar {\n\t[Pulse 1 5]\n}\n")).Parse()
+	if err != nil {
+		t.Fatalf("Parse returned an error: %v", err)
+	}
+
+	score := Score{}
+	err = d.Execute(&score)
+	const expected = "2:5: Bar[1]: pulse 5 is past the end of the bar"
+	if err == nil || err.Error() != expected {
+		t.Errorf("Expected error %q but got %v", expected, err)
+	}
+	if score.Bars[0].Length != 3 {
+		t.Errorf("Expected EndObject to set Length to 3 but got %v", score.Bars[0].Length)
+	}
+	if len(score.Bars[0].begun) != 1 || score.Bars[0].begun[0] != "Pulse" {
+		t.Errorf("Expected BeginDirective to be called with Pulse but got %v", score.Bars[0].begun)
+	}
+}
+
+type Watched struct {
+	Tempo float64
+	begun []string
+}
+
+func (w *Watched) BeginDirective(name string) {
+	w.begun = append(w.begun, name)
+}
+
+func TestExecute_HooksWithoutError(t *testing.T) {
+	d, err := NewParser([]byte("Tempo 120")).Parse()
+	if err != nil {
+		t.Fatalf("Parse returned an error: %v", err)
+	}
+
+	w := Watched{}
+	if err := d.Execute(&w); err != nil {
+		t.Fatalf("Execute returned an error: %v", err)
+	}
+	if len(w.begun) != 1 || w.begun[0] != "Tempo" || w.Tempo != 120 {
+		t.Errorf("Expected BeginDirective to be called with Tempo but got %v", w.begun)
+	}
+}
+
+func TestPlan(t *testing.T) {
+	d, err := NewParser([]byte("Tempo 120\nKit {\n\t[Loop { }]\n}\nRegWave { Pattern \"sin\" }\n")).Parse()
+	if err != nil {
+		t.Fatalf("Parse returned an error: %v", err)
+	}
+
+	doc := Doc{}
+	ops, err := Plan(d, &doc, Options{Unknown: UnknownSkip})
+	if err != nil {
+		t.Fatalf("Plan returned an error: %v", err)
+	}
+	if doc.Tempo != 0 || len(doc.Kits) != 0 {
+		t.Errorf("Expected Plan to leave the target untouched but got %+v", doc)
+	}
+
+	expected := []string{
+		"1:7 Tempo set ast_test.Doc.Tempo 120",
+		"2:5 Kit get (*ast_test.Doc).Kit <nil>",
+		"3:8 Kit.Loop get (*ast_test.Kit).Loop <nil>",
+	}
+	if len(ops) != len(expected) {
+		t.Fatalf("Expected %d operations but got %d: %+v", len(expected), len(ops), ops)
+	}
+	for i, op := range ops {
+		s := fmt.Sprintf("%s %s %s %s %v", op.Pos, op.Path, op.Kind, op.Member, op.Value)
+		if s != expected[i] {
+			t.Errorf("Expected operation %q but got %q", expected[i], s)
+		}
+	}
+}
+
+func TestCompile(t *testing.T) {
+	d, err := NewParser([]byte("Tempo 120\nKit { [Loop { [Measure { [Pulse 1 `0 % 1 2 4`] }] }] }\n")).Parse()
+	if err != nil {
+		t.Fatalf("Parse returned an error: %v", err)
+	}
+
+	p := Compile(d)
+	for i := 0; i < 2; i++ {
+		doc := Doc{}
+		if err := p.Execute(&doc, Options{}); err != nil {
+			t.Fatalf("Execute %d returned an error: %v", i, err)
+		}
+		pulses := doc.Kits[0].Loops[0].Measures[0].Pulses
+		if doc.Tempo != 120 || fmt.Sprint(pulses) != "[1 2 3]" {
+			t.Errorf("Execute %d: unexpected result tempo %v, pulses %v", i, doc.Tempo, pulses)
+		}
+	}
+
+	// The same program compiles its scopes again for another type.
+	var other struct{ Tempo string }
+	if err := p.Execute(&other, Options{Unknown: UnknownSkip}); err != nil {
+		t.Fatalf("Execute returned an error for another type: %v", err)
+	}
+	if other.Tempo != "120" {
+		t.Errorf("Expected tempo %q but got %q", "120", other.Tempo)
+	}
+}
@@ -0,0 +1,51 @@
+package ast_test
+
+import "testing"
+
+import . "github.com/dianelooney/directive/ast"
+
+const benchDoc = `
+Time "4/4"
+Tempo 120
+Kit {
+	Sample "bass_1"
+	Loop { Measure { [Pulse 1 2 3 4] } }
+}
+Kit {
+	Sample "snare_1"
+	Loop { Measure { [Pulse 2.33 2.66 4.33 4.66] } }
+}
+`
+
+func benchExecute(b *testing.B, reset, compiled bool) {
+	d, err := NewParser([]byte(benchDoc)).Parse()
+	if err != nil {
+		b.Fatal(err)
+	}
+	p := Compile(d)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if reset {
+			ResetTypeCache()
+		}
+		if compiled {
+			err = p.Execute(&Doc{}, Options{})
+		} else {
+			err = d.Execute(&Doc{})
+		}
+		if err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// BenchmarkExecute_Uncached resolves the members of every type again on
+// each execution, as Execute did before types were cached.
+func BenchmarkExecute_Uncached(b *testing.B) { benchExecute(b, true, false) }
+
+// BenchmarkExecute_Cached resolves the members of each type once.
+func BenchmarkExecute_Cached(b *testing.B) { benchExecute(b, false, false) }
+
+// BenchmarkExecute_Compiled also reuses the scopes of a compiled Program.
+func BenchmarkExecute_Compiled(b *testing.B) { benchExecute(b, false, true) }
@@ -0,0 +1,149 @@
+package ast
+
+import (
+	"fmt"
+	"reflect"
+)
+
+// runAtomic runs n against a deep copy of x and copies the result back
+// into x only if execution succeeds, so a failing document leaves x as it
+// was.
+//
+// Exported fields are copied deeply. Unexported fields are copied as they
+// are, so the maps, slices and values they point to are shared with the
+// copy and may change even if execution fails, and side effects of methods
+// outside the target are not undone. Pointers to the copy inside the
+// result are pointed back at x. Pointers into the old x held elsewhere
+// keep pointing at the old values.
+func (e *executor) runAtomic(n Node, x interface{}) error {
+	v := reflect.ValueOf(x)
+	if v.Kind() != reflect.Ptr || v.IsNil() {
+		return fmt.Errorf("atomic execution needs a non-nil pointer, got %T", x)
+	}
+
+	stage := cloner{}.clone(v)
+	err := e.run(n, stage.Interface())
+	if err != nil {
+		return err
+	}
+	v.Elem().Set(stage.Elem())
+	repoint(v.Elem(), stage, v, map[uintptr]bool{v.Pointer(): true})
+	return nil
+}
+
+// repoint replaces the pointers to from that v reaches through exported
+// state with pointers to to.
+func repoint(v, from, to reflect.Value, seen map[uintptr]bool) {
+	is := func(p reflect.Value) bool {
+		return p.Kind() == reflect.Ptr && p.Type() == from.Type() && !p.IsNil() && p.Pointer() == from.Pointer()
+	}
+	switch v.Kind() {
+	case reflect.Ptr:
+		if v.IsNil() {
+			return
+		}
+		if is(v) {
+			if v.CanSet() {
+				v.Set(to)
+			}
+			return
+		}
+		if seen[v.Pointer()] {
+			return
+		}
+		seen[v.Pointer()] = true
+		repoint(v.Elem(), from, to, seen)
+	case reflect.Interface:
+		if v.IsNil() {
+			return
+		}
+		if is(v.Elem()) {
+			if v.CanSet() {
+				v.Set(to)
+			}
+			return
+		}
+		repoint(v.Elem(), from, to, seen)
+	case reflect.Slice, reflect.Array:
+		for i := 0; i < v.Len(); i++ {
+			repoint(v.Index(i), from, to, seen)
+		}
+	case reflect.Map:
+		iter := v.MapRange()
+		for iter.Next() {
+			if is(iter.Value()) {
+				v.SetMapIndex(iter.Key(), to)
+				continue
+			}
+			repoint(iter.Value(), from, to, seen)
+		}
+	case reflect.Struct:
+		for i := 0; i < v.NumField(); i++ {
+			if v.Type().Field(i).IsExported() {
+				repoint(v.Field(i), from, to, seen)
+			}
+		}
+	}
+}
+
+// cloner deep copies values, keeping shared and cyclic pointers intact.
+type cloner map[uintptr]reflect.Value
+
+func (c cloner) clone(v reflect.Value) reflect.Value {
+	switch v.Kind() {
+	case reflect.Ptr:
+		if v.IsNil() {
+			return v
+		}
+		if p, ok := c[v.Pointer()]; ok && p.Type() == v.Type() {
+			return p
+		}
+		p := reflect.New(v.Type().Elem())
+		c[v.Pointer()] = p
+		p.Elem().Set(c.clone(v.Elem()))
+		return p
+	case reflect.Interface:
+		if v.IsNil() {
+			return v
+		}
+		out := reflect.New(v.Type()).Elem()
+		out.Set(c.clone(v.Elem()))
+		return out
+	case reflect.Slice:
+		if v.IsNil() {
+			return v
+		}
+		out := reflect.MakeSlice(v.Type(), v.Len(), v.Cap())
+		for i := 0; i < v.Len(); i++ {
+			out.Index(i).Set(c.clone(v.Index(i)))
+		}
+		return out
+	case reflect.Map:
+		if v.IsNil() {
+			return v
+		}
+		out := reflect.MakeMapWithSize(v.Type(), v.Len())
+		iter := v.MapRange()
+		for iter.Next() {
+			out.SetMapIndex(iter.Key(), c.clone(iter.Value()))
+		}
+		return out
+	case reflect.Array:
+		out := reflect.New(v.Type()).Elem()
+		out.Set(v)
+		for i := 0; i < v.Len(); i++ {
+			out.Index(i).Set(c.clone(v.Index(i)))
+		}
+		return out
+	case reflect.Struct:
+		out := reflect.New(v.Type()).Elem()
+		out.Set(v)
+		for i := 0; i < v.NumField(); i++ {
+			if f := out.Field(i); f.CanSet() {
+				f.Set(c.clone(v.Field(i)))
+			}
+		}
+		return out
+	}
+	return v
+}
@@ -0,0 +1,616 @@
+package ast
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"reflect"
+	"sort"
+	"strings"
+
+	"github.com/dianelooney/directive/eval"
+)
+
+// DirectiveBeginner is implemented by targets that want to see, or
+// reject, each directive before it is executed into them. Targets that
+// only watch directives may leave out the error result: a method
+// BeginDirective(name string) is called the same way.
+type DirectiveBeginner interface {
+	BeginDirective(name string) error
+}
+
+// beginner returns x's BeginDirective hook, if it has one.
+func beginner(x interface{}) func(name string) error {
+	switch b := x.(type) {
+	case DirectiveBeginner:
+		return b.BeginDirective
+	case interface{ BeginDirective(name string) }:
+		return func(name string) error {
+			b.BeginDirective(name)
+			return nil
+		}
+	}
+	return nil
+}
+
+// ObjectEnder is implemented by targets that need to finalize themselves
+// once the block executed into them closes, such as computing derived
+// fields.
+type ObjectEnder interface {
+	EndObject() error
+}
+
+// Validator is implemented by targets that check their own state once
+// their block closes, after EndObject.
+type Validator interface {
+	Validate() error
+}
+
+// hooks are the method names of the lifecycle interfaces, which are never
+// treated as directives.
+var hooks = map[string]bool{
+	"BeginDirective": true,
+	"EndObject":      true,
+	"Validate":       true,
+}
+
+// Error is an error returned while executing a directive or block, with
+// the position and path of where it happened.
+type Error struct {
+	Pos  Position
+	Path string
+	Err  error
+}
+
+func (e *Error) Error() string {
+	if e.Path == "" {
+		return fmt.Sprintf("%s: %v", e.Pos, e.Err)
+	}
+	return fmt.Sprintf("%s: %s: %v", e.Pos, e.Path, e.Err)
+}
+
+func (e *Error) Unwrap() error {
+	return e.Err
+}
+
+// Errors is every error of an execution with Options.AllErrors, in
+// document order. Like the result of errors.Join, it unwraps to its
+// entries, so errors.Is and errors.As look through all of them.
+type Errors []*Error
+
+func (es Errors) Error() string {
+	strs := make([]string, len(es))
+	for i, err := range es {
+		strs[i] = err.Error()
+	}
+	return strings.Join(strs, "\n")
+}
+
+func (es Errors) Unwrap() []error {
+	out := make([]error, len(es))
+	for i, err := range es {
+		out[i] = err
+	}
+	return out
+}
+
+// UnknownPolicy decides what Execute does with a directive its target has
+// no method or field for.
+type UnknownPolicy uint8
+
+const (
+	// UnknownError fails Execute. It is the default.
+	UnknownError UnknownPolicy = iota
+	// UnknownSkip ignores the directive and reports it to Options.Warn.
+	UnknownSkip
+	// UnknownCollect appends the directive node to the target's field
+	// tagged `directive:",remain"`, which must be a []Node, so it can be
+	// written back later. An unknown directive for a target without such
+	// a field fails Execute, as it could not be written back.
+	UnknownCollect
+)
+
+// DuplicatePolicy decides what Execute does when a scope sets the same
+// field more than once, by separate directives or, for a scalar field, by
+// the values of a repeated directive. Setter methods are called for every
+// directive regardless.
+type DuplicatePolicy uint8
+
+const (
+	// DuplicateDefault keeps the last value of scalar fields and appends
+	// to slice fields.
+	DuplicateDefault DuplicatePolicy = iota
+	// DuplicateLast keeps the values of the last directive.
+	DuplicateLast
+	// DuplicateFirst keeps the values of the first directive and ignores
+	// the rest.
+	DuplicateFirst
+	// DuplicateError fails Execute.
+	DuplicateError
+	// DuplicateAppend appends to slice fields. Scalar fields keep the last
+	// value.
+	DuplicateAppend
+)
+
+var duplicatePolicies = map[string]DuplicatePolicy{
+	"last":   DuplicateLast,
+	"first":  DuplicateFirst,
+	"error":  DuplicateError,
+	"append": DuplicateAppend,
+}
+
+// Options configures ExecuteWith. The zero value behaves like Node.Execute.
+type Options struct {
+	Unknown UnknownPolicy
+	// Duplicates applies to fields without a `duplicate` tag.
+	Duplicates DuplicatePolicy
+	// Warn, if set, is called with an *Error for every directive that was
+	// skipped.
+	Warn func(err error)
+	// Atomic executes into a deep copy of the target and applies the
+	// result only if the whole node executes without error. The target
+	// must be a pointer. Only exported state is copied: unexported fields
+	// share their maps, slices and pointers with the copy, so changes to
+	// them are kept even if the node fails.
+	Atomic bool
+	// Logger, if set, receives a debug record for every value set and
+	// every block entered, and a warning for every value ignored.
+	Logger *slog.Logger
+	// Limits bounds the resources the execution may use.
+	Limits Limits
+	// AllErrors keeps executing past a failing directive, skipping only
+	// the directive, value or block that failed, and returns every error
+	// as Errors.
+	AllErrors bool
+	// Macros resolves the operators and functions of macros. Nil is the
+	// default eval registry.
+	Macros *eval.Registry
+	// Seed seeds the random functions of macros for documents without a
+	// SeedDirective. The same seed always expands a macro the same way.
+	Seed uint64
+	// Exact evaluates macros with rational numbers and converts them to
+	// float64 only when they are set, see eval.EvalRat.
+	Exact bool
+}
+
+// ExecuteWith executes n into x like n.Execute, configured by o.
+func ExecuteWith(n Node, x interface{}, o Options) error {
+	return ExecuteContext(context.Background(), n, x, o)
+}
+
+// executor holds the state of a single Execute call.
+type executor struct {
+	opts Options
+	ctx  context.Context
+	used usage
+
+	// violations collects struct tag constraints that failed. They do not
+	// stop execution and are returned together once it finishes.
+	violations Diagnostics
+
+	// errs collects the errors of failed directives with AllErrors.
+	errs Errors
+
+	// dry records operations in ops instead of calling methods on the
+	// target. It runs against a staging copy, see Plan.
+	dry bool
+	ops []Operation
+
+	// prog, if set, caches macro expansions and converted values across
+	// executions.
+	prog *Program
+
+	// seed seeds the macros, and seedDir is the SeedDirective it came
+	// from, if any.
+	seed    uint64
+	seedDir *Directive
+}
+
+func execute(n Node, x interface{}) error {
+	return (&executor{}).run(n, x)
+}
+
+func (e *executor) run(n Node, x interface{}) error {
+	var err error
+	e.seed = e.opts.Seed
+	switch v := n.(type) {
+	case *Document:
+		if err := e.seeded(v); err != nil {
+			return err
+		}
+		err = e.scope(v, v.Directives, x, "", v.Begin())
+	case *Object:
+		err = e.scope(v, v.Directives, x, "", v.Begin())
+	case *Directive:
+		d := &e.compiled(v, []Node{v}, x, "").dirs[0]
+		err = e.fail(e.directive(x, d), v.Value.Begin(), d.path)
+	case *RepeatedDirective:
+		err = e.repeated(x, &e.compiled(v, []Node{v}, x, "").dirs[0])
+	default:
+		return fmt.Errorf("cannot execute %T", n)
+	}
+	if err != nil {
+		// A fatal error stops AllErrors execution, but keeps the errors
+		// collected before it.
+		var xerr *Error
+		if !e.opts.AllErrors || !errors.As(err, &xerr) {
+			return err
+		}
+		e.errs = append(e.errs, xerr)
+	}
+	if e.errs != nil || (e.opts.AllErrors && e.violations != nil) {
+		for _, d := range e.violations {
+			e.errs = append(e.errs, &Error{Pos: d.Pos, Path: d.Path, Err: errors.New(d.Message)})
+		}
+		sort.SliceStable(e.errs, func(i, j int) bool {
+			return e.errs[i].Pos.Byte < e.errs[j].Pos.Byte
+		})
+		return e.errs
+	}
+	if e.violations != nil {
+		sort.SliceStable(e.violations, func(i, j int) bool {
+			return e.violations[i].Pos.Byte < e.violations[j].Pos.Byte
+		})
+		return e.violations
+	}
+	return nil
+}
+
+// seeded takes the seed of the macros of doc from its SeedDirective.
+func (e *executor) seeded(doc *Document) error {
+	dir, seed, err := Seed(doc)
+	if err != nil {
+		return e.fail(err, doc.Begin(), "")
+	}
+	if dir != nil {
+		e.seed, e.seedDir = seed, dir
+	}
+	return nil
+}
+
+func (e *executor) violation(pos Position, path string, err error) {
+	e.violations = append(e.violations, Diagnostic{Pos: pos, Path: path, Message: err.Error()})
+}
+
+// scope executes dirs, the directives of the document or object n, into
+// x, then applies x's defaults, checks its required fields and
+// constraints and calls its EndObject and Validate hooks.
+func (e *executor) scope(n Node, dirs []Node, x interface{}, path string, pos Position) error {
+	c := e.compiled(n, dirs, x, path)
+	seen := map[string]Position{}
+	begin := beginner(x)
+	if e.dry {
+		begin = nil
+	}
+	for i := range c.dirs {
+		d := &c.dirs[i]
+		if err := e.count(d.n.Begin(), d.path); err != nil {
+			return err
+		}
+		if d.n == Node(e.seedDir) && !d.ok {
+			continue
+		}
+
+		if e.opts.Unknown != UnknownError && !d.ok && !known(x, d.ident, d.isObject) {
+			err := e.unknown(x, d)
+			if err != nil {
+				return err
+			}
+			continue
+		}
+
+		if prev, dup := seen[d.ident]; dup {
+			run, err := e.duplicate(x, d, prev)
+			if err := e.fail(err, d.n.Begin(), d.path); err != nil {
+				return err
+			}
+			if !run {
+				continue
+			}
+		} else {
+			seen[d.ident] = d.n.Begin()
+		}
+		if begin != nil {
+			if err := begin(d.ident); err != nil {
+				err = &Error{Pos: d.n.Begin(), Path: d.path, Err: err}
+				if err := e.fail(err, d.n.Begin(), ""); err != nil {
+					return err
+				}
+				continue
+			}
+		}
+
+		switch n := d.n.(type) {
+		case *Directive:
+			if err := e.fail(e.directive(x, d), n.Value.Begin(), d.path); err != nil {
+				return err
+			}
+		case *RepeatedDirective:
+			if err := e.repeated(x, d); err != nil {
+				return err
+			}
+		}
+	}
+
+	err := e.fail(e.finish(x, seen, path, pos), pos, path)
+	if err != nil || e.dry {
+		return err
+	}
+	if end, ok := x.(ObjectEnder); ok {
+		if err := end.EndObject(); err != nil {
+			return e.fail(&Error{Pos: pos, Path: path, Err: err}, pos, path)
+		}
+	}
+	if v, ok := x.(Validator); ok {
+		if err := v.Validate(); err != nil {
+			return e.fail(&Error{Pos: pos, Path: path, Err: err}, pos, path)
+		}
+	}
+	return nil
+}
+
+// fail handles the error of a single directive, value or scope. It wraps
+// err in an *Error at pos and path unless it already has a position. With
+// Options.AllErrors it records the error and returns nil so execution
+// skips only the failed subtree; exceeded limits and a done context still
+// stop execution, and are returned after the errors recorded before them.
+func (e *executor) fail(err error, pos Position, path string) error {
+	if err == nil {
+		return nil
+	}
+	var xerr *Error
+	if !errors.As(err, &xerr) {
+		xerr = &Error{Pos: pos, Path: path, Err: err}
+		err = xerr
+	}
+	if !e.opts.AllErrors || fatal(err) {
+		return err
+	}
+	e.errs = append(e.errs, xerr)
+	return nil
+}
+
+func fatal(err error) bool {
+	var lerr *LimitError
+	return errors.As(err, &lerr) || errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded)
+}
+
+// directive executes the single value of the directive d.
+func (e *executor) directive(x interface{}, d *compiledDirective) error {
+	switch v := d.n.(*Directive).Value.(type) {
+	case *Object:
+		return e.object(x, d.ident, v, d.path)
+	case *String:
+		return e.set(x, d.ident, v.Value, d.values[0], v.Begin(), d.path)
+	case *Number:
+		return e.set(x, d.ident, v.Value, d.values[0], v.Begin(), d.path)
+	case *Note:
+		return e.set(x, d.ident, v.Value, d.values[0], v.Begin(), d.path)
+	case *Unknown:
+		return e.set(x, d.ident, v.Value, d.values[0], v.Begin(), d.path)
+	}
+	return fmt.Errorf("unhandled value type %T", d.n.(*Directive).Value)
+}
+
+func (e *executor) repeated(x interface{}, d *compiledDirective) error {
+	r := d.n.(*RepeatedDirective)
+	for i, value := range r.Values {
+		path := d.paths[i]
+		if err := e.count(value.Begin(), path); err != nil {
+			return err
+		}
+		if i > 0 {
+			run, err := e.again(x, d, i)
+			if err := e.fail(err, value.Begin(), path); err != nil {
+				return err
+			}
+			if !run {
+				continue
+			}
+		}
+		err := e.value(x, d, i)
+		if err := e.fail(err, value.Begin(), path); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// value executes the i-th value of the repeated directive d. Macros are
+// expanded into one value per element.
+func (e *executor) value(x interface{}, d *compiledDirective, i int) error {
+	ident, path, conv := d.ident, d.paths[i], d.values[i]
+	switch v := d.n.(*RepeatedDirective).Values[i].(type) {
+	case *Object:
+		return e.object(x, ident, v, path)
+	case *String:
+		if !v.IsMacro {
+			return e.set(x, ident, v.Value, conv, v.Begin(), path)
+		}
+		return e.macro(x, ident, v, path)
+	case *Number:
+		return e.set(x, ident, v.Value, conv, v.Begin(), path)
+	case *Note:
+		return e.set(x, ident, v.Value, conv, v.Begin(), path)
+	case *Unknown:
+		return e.set(x, ident, v.Value, conv, v.Begin(), path)
+	default:
+		return fmt.Errorf("unhandled value type %T", v)
+	}
+}
+
+// object executes o into the value returned by x's getter for ident,
+// falling back to a registered block kind.
+func (e *executor) object(x interface{}, ident string, o *Object, path string) error {
+	if l := e.opts.Logger; l != nil && !e.dry {
+		l.Debug("directive: block", "pos", o.Begin().String(), "path", path, "target", fmt.Sprintf("%T", x))
+	}
+	e.used.depth++
+	defer func() { e.used.depth-- }()
+	if err := e.check(LimitDepth, e.used.depth, e.opts.Limits.MaxDepth, o.Begin(), path); err != nil {
+		return err
+	}
+
+	y, err := e.get(x, ident, o.Begin(), path)
+	if err == nil {
+		return e.scope(o, o.Directives, y, path, o.Begin())
+	}
+
+	f, ok := lookupKind(ident)
+	if !ok {
+		if hasPolymorphicField(reflect.TypeOf(x)) {
+			return fmt.Errorf("unknown block kind %s for %T; registered kinds: %s", ident, x, strings.Join(Registered(), ", "))
+		}
+		return err
+	}
+
+	y, err = e.create(f, ident, o.Begin(), path)
+	if err != nil {
+		return err
+	}
+	if err := e.scope(o, o.Directives, y, path, o.Begin()); err != nil {
+		return err
+	}
+	name, err := attach(x, ident, y)
+	if err == nil && e.dry {
+		e.record(OpAttach, o.Begin(), path, fmt.Sprintf("%s.%s", reflect.Indirect(reflect.ValueOf(x)).Type(), name), nil)
+	}
+	return err
+}
+
+// finish applies `default` tags to the fields of x no directive in the
+// scope set, then records a violation for every missing `required` field
+// and every set field that fails its `validate` tag.
+func (e *executor) finish(x interface{}, seen map[string]Position, path string, pos Position) error {
+	v := reflect.ValueOf(x)
+	if v.Kind() != reflect.Ptr || v.Elem().Kind() != reflect.Struct {
+		return nil
+	}
+
+	for _, m := range members(v.Type()) {
+		at, ok := seen[m.Name]
+		if !ok && m.Default != nil {
+			for _, d := range m.defaults() {
+				err := e.set(x, m.Name, d, reflect.Value{}, pos, join(path, m.Name))
+				if err != nil {
+					return fmt.Errorf("default for %s: %w", m.Name, err)
+				}
+			}
+			at, ok = pos, true
+		}
+		if !ok {
+			if m.Required {
+				e.violation(pos, path, fmt.Errorf("missing required directive %s", m.Name))
+			}
+			continue
+		}
+		if m.Kind == valueField || m.Kind == sliceField {
+			if err := m.check(fieldOf(v, m.Index)); err != nil {
+				e.violation(at, join(path, m.Name), err)
+			}
+		}
+	}
+	return nil
+}
+
+// identify returns the identifier of a directive node and whether it has
+// object values.
+func identify(n Node) (ident string, isObject bool, ok bool) {
+	switch d := n.(type) {
+	case *Directive:
+		_, isObject = d.Value.(*Object)
+		return d.Identifier, isObject, true
+	case *RepeatedDirective:
+		return d.Identifier, hasObject(d.Values), true
+	}
+	return "", false, false
+}
+
+// known reports whether x has a member for ident, or accepts it as a
+// registered block kind.
+func known(x interface{}, ident string, isObject bool) bool {
+	t := reflect.TypeOf(x)
+	if _, ok := lookup(t, ident); ok {
+		return true
+	}
+	if f, ok := lookupKind(ident); ok && isObject {
+		return acceptsKind(t, f.Type().Out(0))
+	}
+	return false
+}
+
+// unknown handles a directive x has no member for, following the unknown
+// directive policy.
+func (e *executor) unknown(x interface{}, d *compiledDirective) error {
+	if e.opts.Unknown == UnknownCollect {
+		v := reflect.ValueOf(x)
+		if m, ok := remain(v.Type()); ok && v.Kind() == reflect.Ptr {
+			f := fieldOf(v, m.Index)
+			f.Set(reflect.Append(f, reflect.ValueOf(d.n)))
+			if e.dry {
+				e.record(OpCollect, d.n.Begin(), d.path, memberString(v.Type(), m), d.n.Text())
+			}
+			return nil
+		}
+		err := fmt.Errorf("unknown directive %s for %T, which has no field tagged `directive:\",remain\"` to collect it", d.ident, x)
+		return e.fail(&Error{Pos: d.n.Begin(), Path: d.path, Err: err}, d.n.Begin(), d.path)
+	}
+
+	if e.opts.Warn != nil {
+		e.opts.Warn(&Error{Pos: d.n.Begin(), Path: d.path, Err: fmt.Errorf("skipped unknown directive %s for %T", d.ident, x)})
+	}
+	return nil
+}
+
+// again applies the duplicate policy of a scalar field to the i-th value of
+// the repeated directive d, which sets the field again, and reports
+// whether the value should still be executed.
+func (e *executor) again(x interface{}, d *compiledDirective, i int) (bool, error) {
+	v := reflect.ValueOf(x)
+	if !d.ok || d.m.Kind != valueField || v.Kind() != reflect.Ptr {
+		return true, nil
+	}
+
+	values := d.n.(*RepeatedDirective).Values
+	switch d.m.policy(e.opts.Duplicates) {
+	case DuplicateFirst:
+		if e.dry {
+			e.record(OpSkip, values[i].Begin(), d.paths[i], memberString(v.Type(), d.m), nil)
+		}
+		return false, nil
+	case DuplicateError:
+		return false, &Error{Pos: values[i].Begin(), Path: d.paths[i], Err: fmt.Errorf("%s is set more than once; first set at %s", d.ident, values[0].Begin())}
+	}
+	return true, nil
+}
+
+// duplicate applies the duplicate policy to the directive d for a field
+// that was first set at prev in the same scope, and reports whether the
+// directive should still be executed.
+func (e *executor) duplicate(x interface{}, d *compiledDirective, prev Position) (bool, error) {
+	v := reflect.ValueOf(x)
+	m := d.m
+	if !d.ok || (m.Kind != valueField && m.Kind != sliceField) || v.Kind() != reflect.Ptr {
+		return true, nil
+	}
+
+	switch m.policy(e.opts.Duplicates) {
+	case DuplicateFirst:
+		if e.dry {
+			e.record(OpSkip, d.n.Begin(), d.path, memberString(v.Type(), m), nil)
+		}
+		return false, nil
+	case DuplicateError:
+		return false, &Error{Pos: d.n.Begin(), Path: d.path, Err: fmt.Errorf("%s is set more than once; first set at %s", d.ident, prev)}
+	case DuplicateLast:
+		if m.Kind == sliceField {
+			f := fieldOf(v, m.Index)
+			f.Set(reflect.Zero(f.Type()))
+			if e.dry {
+				e.record(OpReset, d.n.Begin(), d.path, memberString(v.Type(), m), nil)
+			}
+		}
+	}
+	return true, nil
+}
@@ -0,0 +1,20 @@
+package ast
+
+// ResetTypeCache forgets the members of every type, so that benchmarks can
+// measure executions that resolve them again.
+func ResetTypeCache() {
+	typeInfos.Clear()
+}
+
+// MaxCachedMacro is the longest macro expansion a Program keeps.
+const MaxCachedMacro = maxCachedMacro
+
+// CachedMacroValues returns the number of macro values p keeps.
+func CachedMacroValues(p *Program) int {
+	n := 0
+	p.macros.Range(func(_, v interface{}) bool {
+		n += len(v.([]string))
+		return true
+	})
+	return n
+}
@@ -0,0 +1,90 @@
+package ast
+
+import (
+	"context"
+	"fmt"
+)
+
+// Limits bounds the resources a single execution may use. A zero field is
+// unlimited.
+type Limits struct {
+	// MaxDepth is the deepest nesting of blocks.
+	MaxDepth int
+	// MaxNodes is the number of directives and values executed.
+	MaxNodes int
+	// MaxMacroLength is the number of values a single macro, or any part
+	// of it, may expand to.
+	MaxMacroLength int
+	// MaxSets is the number of values set, including those macros expand
+	// to.
+	MaxSets int
+}
+
+// Limit names one of the fields of Limits.
+type Limit string
+
+const (
+	LimitDepth       Limit = "depth"
+	LimitNodes       Limit = "node"
+	LimitMacroLength Limit = "macro length"
+	LimitSets        Limit = "set"
+)
+
+// LimitError is returned, wrapped in an *Error, when an execution exceeds
+// one of its Limits.
+type LimitError struct {
+	Limit Limit
+	Max   int
+}
+
+func (e *LimitError) Error() string {
+	return fmt.Sprintf("%s limit of %d exceeded", e.Limit, e.Max)
+}
+
+// ExecuteContext executes n into x like ExecuteWith. It stops with ctx's
+// error once ctx is done.
+func ExecuteContext(ctx context.Context, n Node, x interface{}, o Options) error {
+	e := &executor{opts: o, ctx: ctx}
+	if o.Atomic {
+		return e.runAtomic(n, x)
+	}
+	return e.run(n, x)
+}
+
+// usage counts what an execution has used against its Limits.
+type usage struct {
+	depth int
+	nodes int
+	sets  int
+}
+
+// doneEvery is how many values are set between checks of the context, so
+// that a long macro stops soon after the context is done.
+const doneEvery = 1 << 10
+
+// done returns the context's error once it is done.
+func (e *executor) done(pos Position, path string) error {
+	if e.ctx != nil {
+		if err := e.ctx.Err(); err != nil {
+			return &Error{Pos: pos, Path: path, Err: err}
+		}
+	}
+	return nil
+}
+
+// count checks the context and counts a directive or value against the
+// node limit.
+func (e *executor) count(pos Position, path string) error {
+	if err := e.done(pos, path); err != nil {
+		return err
+	}
+	e.used.nodes++
+	return e.check(LimitNodes, e.used.nodes, e.opts.Limits.MaxNodes, pos, path)
+}
+
+func (e *executor) check(l Limit, n, max int, pos Position, path string) error {
+	if max > 0 && n > max {
+		return &Error{Pos: pos, Path: path, Err: &LimitError{Limit: l, Max: max}}
+	}
+	return nil
+}
@@ -0,0 +1,373 @@
+package ast
+
+import (
+	"fmt"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+type memberKind uint8
+
+const (
+	// getterMethod is a method with no arguments whose first result is the
+	// target of an object directive.
+	getterMethod memberKind = iota
+	// setterMethod is a method called once for every value of a directive.
+	// A setter without arguments is called with the value ignored.
+	setterMethod
+	// valueField is a scalar field set by a single directive.
+	valueField
+	// sliceField is a slice of scalars appended to by every value.
+	sliceField
+	// objectField is a struct, pointer to struct or interface field that
+	// object directives execute into.
+	objectField
+	// remainField is a []Node field tagged `directive:",remain"` that
+	// collects unknown directives. It has no name.
+	remainField
+	// invalidMember is a method whose signature cannot take a directive.
+	invalidMember
+)
+
+// member is a method or field of a target type that a directive identifier
+// resolves to.
+type member struct {
+	Name     string
+	Kind     memberKind
+	Index    []int
+	Type     reflect.Type
+	Required bool
+	// Default is the `default` tag, applied when a scope does not set the
+	// field.
+	Default *string
+	// Min, Max and OneOf come from the `validate` tag.
+	Min   *float64
+	Max   *float64
+	OneOf []string
+	// Duplicates comes from the `duplicate` tag.
+	Duplicates DuplicatePolicy
+	// Invalid is set when the field's tags could not be parsed.
+	Invalid error
+}
+
+// Repeatable reports whether more than one value may be given for m.
+func (m member) Repeatable() bool {
+	return m.Kind == setterMethod || m.Kind == sliceField || m.Kind == getterMethod
+}
+
+// policy returns the duplicate policy of m, which is def unless m has a
+// `duplicate` tag.
+func (m member) policy(def DuplicatePolicy) DuplicatePolicy {
+	if m.Duplicates != DuplicateDefault {
+		return m.Duplicates
+	}
+	return def
+}
+
+// Object reports whether m accepts object values.
+func (m member) Object() bool {
+	return m.Kind == getterMethod || m.Kind == objectField
+}
+
+// typeInfo is everything the executor needs to know about a target type.
+// It is computed once per type and cached.
+type typeInfo struct {
+	byName  map[string]member
+	members []member
+	remain  *member
+}
+
+var typeInfos sync.Map
+
+func infoOf(t reflect.Type) *typeInfo {
+	if ti, ok := typeInfos.Load(t); ok {
+		return ti.(*typeInfo)
+	}
+
+	ti := &typeInfo{byName: map[string]member{}}
+	for i := 0; i < t.NumMethod(); i++ {
+		m := t.Method(i)
+		if mm, ok := method(m); ok {
+			ti.members = append(ti.members, mm)
+			ti.byName[m.Name] = mm
+		} else {
+			// A method that cannot take a directive still hides the field
+			// with its name.
+			ti.byName[m.Name] = member{Kind: invalidMember}
+		}
+	}
+	for _, m := range fields(t) {
+		if m.Kind == remainField {
+			m := m
+			ti.remain = &m
+			continue
+		}
+		if _, ok := ti.byName[m.Name]; !ok {
+			ti.members = append(ti.members, m)
+			ti.byName[m.Name] = m
+		}
+	}
+
+	actual, _ := typeInfos.LoadOrStore(t, ti)
+	return actual.(*typeInfo)
+}
+
+// lookup resolves name against t following the rules Execute uses: methods
+// of t come first, then exported fields of the struct t points to, matched
+// by their `directive` tag or, without one, their name.
+func lookup(t reflect.Type, name string) (member, bool) {
+	if t == nil {
+		return member{}, false
+	}
+	m, ok := infoOf(t).byName[name]
+	return m, ok && m.Kind != invalidMember
+}
+
+// remain returns the field of t that collects unknown directives.
+func remain(t reflect.Type) (member, bool) {
+	if t == nil {
+		return member{}, false
+	}
+	if m := infoOf(t).remain; m != nil {
+		return *m, true
+	}
+	return member{}, false
+}
+
+// members lists every identifier t accepts.
+func members(t reflect.Type) []member {
+	if t == nil {
+		return nil
+	}
+	return infoOf(t).members
+}
+
+func method(m reflect.Method) (member, bool) {
+	if hooks[m.Name] {
+		return member{}, false
+	}
+	mt := m.Type
+	switch {
+	case mt.NumIn() == 1 && mt.NumOut() > 0:
+		return member{Name: m.Name, Kind: getterMethod, Index: []int{m.Index}, Type: mt.Out(0)}, true
+	case mt.NumIn() == 1:
+		return member{Name: m.Name, Kind: setterMethod, Index: []int{m.Index}}, true
+	case mt.NumIn() == 2 && scalar(mt.In(1)):
+		return member{Name: m.Name, Kind: setterMethod, Index: []int{m.Index}, Type: mt.In(1)}, true
+	}
+	return member{}, false
+}
+
+func fields(t reflect.Type) (out []member) {
+	if t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	if t.Kind() != reflect.Struct {
+		return nil
+	}
+	for _, f := range reflect.VisibleFields(t) {
+		if f.PkgPath != "" || f.Anonymous {
+			continue
+		}
+		m := member{Name: f.Name, Index: f.Index, Type: f.Type}
+		if tag, ok := f.Tag.Lookup("directive"); ok {
+			opts := strings.Split(tag, ",")
+			if opts[0] == "-" {
+				continue
+			}
+			if opts[0] != "" {
+				m.Name = opts[0]
+			}
+			for _, o := range opts[1:] {
+				switch o {
+				case "required":
+					m.Required = true
+				case "remain":
+					m.Kind = remainField
+				}
+			}
+		}
+		if d, ok := f.Tag.Lookup("default"); ok {
+			m.Default = &d
+		}
+		if v, ok := f.Tag.Lookup("validate"); ok {
+			m.Invalid = m.parseValidate(v)
+		}
+		if d, ok := f.Tag.Lookup("duplicate"); ok {
+			p, ok := duplicatePolicies[d]
+			if !ok {
+				m.Invalid = fmt.Errorf("unknown duplicate policy %q for %s", d, m.Name)
+			}
+			m.Duplicates = p
+		}
+
+		switch {
+		case m.Kind == remainField:
+			if f.Type != reflect.TypeOf([]Node(nil)) {
+				continue
+			}
+			m.Name = ""
+		case scalar(f.Type):
+			m.Kind = valueField
+		case f.Type.Kind() == reflect.Slice && scalar(f.Type.Elem()):
+			m.Kind = sliceField
+			m.Type = f.Type.Elem()
+		case f.Type.Kind() == reflect.Struct:
+			m.Kind = objectField
+			m.Type = reflect.PtrTo(f.Type)
+		case f.Type.Kind() == reflect.Ptr && f.Type.Elem().Kind() == reflect.Struct,
+			f.Type.Kind() == reflect.Interface:
+			m.Kind = objectField
+		default:
+			continue
+		}
+		out = append(out, m)
+	}
+	return out
+}
+
+// scalar reports whether convert can produce a value of type t.
+func scalar(t reflect.Type) bool {
+	switch t.Kind() {
+	case reflect.String, reflect.Bool,
+		reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64,
+		reflect.Float32, reflect.Float64:
+		return true
+	}
+	return false
+}
+
+// convert parses a directive value into a value of type t.
+func convert(value string, t reflect.Type) (reflect.Value, error) {
+	v := reflect.New(t).Elem()
+	switch t.Kind() {
+	case reflect.String:
+		v.SetString(value)
+	case reflect.Bool:
+		b, err := strconv.ParseBool(value)
+		if err != nil {
+			return v, err
+		}
+		v.SetBool(b)
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		i, err := strconv.ParseInt(value, 10, t.Bits())
+		if err != nil {
+			return v, err
+		}
+		v.SetInt(i)
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		u, err := strconv.ParseUint(value, 10, t.Bits())
+		if err != nil {
+			return v, err
+		}
+		v.SetUint(u)
+	case reflect.Float32, reflect.Float64:
+		f, err := strconv.ParseFloat(value, t.Bits())
+		if err != nil {
+			return v, err
+		}
+		v.SetFloat(f)
+	default:
+		return v, fmt.Errorf("unsupported kind %s", t.Kind())
+	}
+	return v, nil
+}
+
+// fieldOf returns the field of x at index, allocating nil pointers on the way.
+func fieldOf(x reflect.Value, index []int) reflect.Value {
+	v := reflect.Indirect(x)
+	for i, idx := range index {
+		if i > 0 && v.Kind() == reflect.Ptr {
+			if v.IsNil() {
+				v.Set(reflect.New(v.Type().Elem()))
+			}
+			v = v.Elem()
+		}
+		v = v.Field(idx)
+	}
+	return v
+}
+
+// parseValidate reads a `validate` tag such as "min=0,max=1" or
+// "oneof=sin square saw".
+func (m *member) parseValidate(tag string) error {
+	for _, rule := range strings.Split(tag, ",") {
+		kv := strings.SplitN(rule, "=", 2)
+		if len(kv) != 2 {
+			return fmt.Errorf("invalid validate rule %q for %s", rule, m.Name)
+		}
+		switch kv[0] {
+		case "min", "max":
+			f, err := strconv.ParseFloat(kv[1], 64)
+			if err != nil {
+				return fmt.Errorf("invalid validate rule %q for %s: %v", rule, m.Name, err)
+			}
+			if kv[0] == "min" {
+				m.Min = &f
+			} else {
+				m.Max = &f
+			}
+		case "oneof":
+			m.OneOf = strings.Fields(kv[1])
+		default:
+			return fmt.Errorf("unknown validate rule %q for %s", kv[0], m.Name)
+		}
+	}
+	return nil
+}
+
+// defaults splits the default tag into the values to set. Slice fields
+// take a space separated list.
+func (m member) defaults() []string {
+	if m.Kind == sliceField {
+		return strings.Fields(*m.Default)
+	}
+	return []string{*m.Default}
+}
+
+// check reports whether v satisfies m's validate tag. Numbers are compared
+// against min and max, strings by their length.
+func (m member) check(v reflect.Value) error {
+	if m.Invalid != nil {
+		return m.Invalid
+	}
+	if v.Kind() == reflect.Slice {
+		for i := 0; i < v.Len(); i++ {
+			if err := m.check(v.Index(i)); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	var f float64
+	switch v.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		f = float64(v.Int())
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		f = float64(v.Uint())
+	case reflect.Float32, reflect.Float64:
+		f = v.Float()
+	case reflect.String:
+		f = float64(len(v.String()))
+	}
+	if m.Min != nil && f < *m.Min {
+		return fmt.Errorf("%s must be at least %v, got %v", m.Name, *m.Min, v.Interface())
+	}
+	if m.Max != nil && f > *m.Max {
+		return fmt.Errorf("%s must be at most %v, got %v", m.Name, *m.Max, v.Interface())
+	}
+	if len(m.OneOf) > 0 {
+		s := fmt.Sprint(v.Interface())
+		for _, o := range m.OneOf {
+			if o == s {
+				return nil
+			}
+		}
+		return fmt.Errorf("%s must be one of %s, got %s", m.Name, strings.Join(m.OneOf, ", "), s)
+	}
+	return nil
+}
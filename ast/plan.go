@@ -0,0 +1,183 @@
+package ast
+
+import (
+	"fmt"
+	"log/slog"
+	"reflect"
+)
+
+// OpKind is the kind of an Operation.
+type OpKind string
+
+const (
+	// OpGet calls a getter method to obtain the target of a block.
+	OpGet OpKind = "get"
+	// OpField uses a struct or pointer field as the target of a block,
+	// allocating it if it is nil.
+	OpField OpKind = "field"
+	// OpCreate calls a registered factory for a block kind.
+	OpCreate OpKind = "create"
+	// OpAttach stores a created block in a slice or map field.
+	OpAttach OpKind = "attach"
+	// OpCall calls a setter method with a value.
+	OpCall OpKind = "call"
+	// OpSet sets a scalar field.
+	OpSet OpKind = "set"
+	// OpAppend appends a value to a slice field.
+	OpAppend OpKind = "append"
+	// OpReset clears a slice field before a duplicate directive replaces
+	// its values.
+	OpReset OpKind = "reset"
+	// OpSkip ignores a duplicate directive.
+	OpSkip OpKind = "skip"
+	// OpCollect stores an unknown directive in the remain field.
+	OpCollect OpKind = "collect"
+)
+
+// Operation is a single step Execute performs on a target.
+type Operation struct {
+	Kind   OpKind      `json:"kind"`
+	Path   string      `json:"path"`
+	Pos    Position    `json:"pos"`
+	Member string      `json:"member"`
+	Value  interface{} `json:"value,omitempty"`
+}
+
+// Plan returns the operations ExecuteWith(n, x, o) would perform, in
+// order, without calling any getter or setter on x. It runs against a
+// staging copy of x, so the plan reflects x's current state, and fails
+// where Execute would.
+//
+// Lifecycle hooks are not called, so errors they would return are not
+// reported. Factories that return an interface type are called to learn
+// the concrete type of their blocks; the values are discarded.
+func Plan(n Node, x interface{}, o Options) ([]Operation, error) {
+	v := reflect.ValueOf(x)
+	if v.Kind() == reflect.Ptr && !v.IsNil() {
+		x = cloner{}.clone(v).Interface()
+	}
+
+	e := &executor{opts: o, dry: true}
+	err := e.run(n, x)
+	return e.ops, err
+}
+
+func (e *executor) record(kind OpKind, pos Position, path string, member string, value interface{}) {
+	e.ops = append(e.ops, Operation{Kind: kind, Path: path, Pos: pos, Member: member, Value: value})
+}
+
+// memberString names m the way Go code would refer to it, such as
+// (*song.Kit).Pulse for a method or song.Kit.Volume for a field.
+func memberString(t reflect.Type, m member) string {
+	if m.Kind == getterMethod || m.Kind == setterMethod {
+		return fmt.Sprintf("(%s).%s", t, t.Method(m.Index[0]).Name)
+	}
+	st := t
+	if st.Kind() == reflect.Ptr {
+		st = st.Elem()
+	}
+	return fmt.Sprintf("%s.%s", st, st.FieldByIndex(m.Index).Name)
+}
+
+// set executes a scalar value, or records it in dry mode. conv is value
+// already converted for ident's member, or invalid to convert it here.
+func (e *executor) set(x interface{}, ident string, value string, conv reflect.Value, pos Position, path string) error {
+	e.used.sets++
+	if err := e.check(LimitSets, e.used.sets, e.opts.Limits.MaxSets, pos, path); err != nil {
+		return err
+	}
+	if e.used.sets%doneEvery == 0 {
+		if err := e.done(pos, path); err != nil {
+			return err
+		}
+	}
+	t, m, err := resolveSet(x, ident)
+	if err != nil {
+		return err
+	}
+	v := conv
+	if !v.IsValid() {
+		if v, err = convertSet(m, ident, value); err != nil {
+			return err
+		}
+	}
+	if !e.dry {
+		if l := e.opts.Logger; l != nil {
+			trace(l, t, m, v, value, pos, path)
+		}
+		applySet(t, m, v)
+		return nil
+	}
+
+	kind := OpSet
+	switch m.Kind {
+	case setterMethod:
+		kind = OpCall
+	case sliceField:
+		kind = OpAppend
+		applySet(t, m, v)
+	default:
+		applySet(t, m, v)
+	}
+	var val interface{}
+	if v.IsValid() {
+		val = v.Interface()
+	}
+	e.record(kind, pos, path, memberString(t.Type(), m), val)
+	return nil
+}
+
+// trace logs a set operation to l.
+func trace(l *slog.Logger, t reflect.Value, m member, v reflect.Value, value string, pos Position, path string) {
+	if m.Kind == setterMethod && !v.IsValid() {
+		l.Warn("directive: ignored value for method without arguments", "pos", pos.String(), "path", path, "member", memberString(t.Type(), m), "value", value)
+		return
+	}
+	l.Debug("directive: set", "pos", pos.String(), "path", path, "member", memberString(t.Type(), m), "value", value)
+}
+
+// get returns the target of a block. In dry mode getters are not called;
+// a new value of their result type stands in.
+func (e *executor) get(x interface{}, ident string, pos Position, path string) (interface{}, error) {
+	if !e.dry {
+		return get(x, ident)
+	}
+
+	t := reflect.ValueOf(x)
+	m, ok := lookup(t.Type(), ident)
+	if !ok || (m.Kind != getterMethod && m.Kind != objectField) {
+		return get(x, ident)
+	}
+	if m.Kind == objectField {
+		y, err := get(x, ident)
+		if err == nil {
+			e.record(OpField, pos, path, memberString(t.Type(), m), nil)
+		}
+		return y, err
+	}
+
+	e.record(OpGet, pos, path, memberString(t.Type(), m), nil)
+	if m.Type.Kind() != reflect.Ptr {
+		return nil, fmt.Errorf("cannot plan block %s: %s returns %s, not a pointer", ident, memberString(t.Type(), m), m.Type)
+	}
+	return reflect.New(m.Type.Elem()).Interface(), nil
+}
+
+// create calls the factory for a block kind. In dry mode factories that
+// return a pointer type are not called.
+func (e *executor) create(f reflect.Value, ident string, pos Position, path string) (interface{}, error) {
+	out := f.Type().Out(0)
+	var y interface{}
+	if e.dry && out.Kind() == reflect.Ptr {
+		y = reflect.New(out.Elem()).Interface()
+	} else {
+		y = f.Call(nil)[0].Interface()
+	}
+	if y == nil {
+		return nil, fmt.Errorf("factory for block kind %s returned nil", ident)
+	}
+	if e.dry {
+		e.record(OpCreate, pos, path, fmt.Sprintf("factory %s (%T)", ident, y), nil)
+	}
+	return y, nil
+}
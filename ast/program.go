@@ -0,0 +1,242 @@
+package ast
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"reflect"
+	"sync"
+
+	"github.com/dianelooney/directive/eval"
+)
+
+// Program is a node prepared for repeated execution. It caches the work
+// that depends only on the node and the target types: each scope is
+// compiled once per type it is executed into, and short macros are
+// expanded once. Method and field resolution is cached per type for all
+// executions.
+//
+// A Program is safe for concurrent use.
+type Program struct {
+	node   Node
+	scopes sync.Map // scopeKey -> *compiledScope
+	macros sync.Map // macroKey -> []string
+}
+
+// compiledScope is the directives of a scope compiled for one target type:
+// everything about executing them that does not depend on the target's
+// state.
+type compiledScope struct {
+	dirs []compiledDirective
+}
+
+// compiledDirective is a directive of a compiled scope. m is the member its
+// identifier resolves to, if ok. path is the path of the directive, and
+// paths those of its values. values holds each literal value converted for
+// m, and is invalid for blocks, macros and values left to be converted
+// and reported by the execution.
+type compiledDirective struct {
+	n        Node
+	ident    string
+	isObject bool
+	m        member
+	ok       bool
+	path     string
+	paths    []string
+	values   []reflect.Value
+}
+
+type scopeKey struct {
+	n Node
+	t reflect.Type
+}
+
+// evalMode is everything besides its text that a macro's expansion
+// depends on.
+type evalMode struct {
+	reg   *eval.Registry
+	seed  uint64
+	exact bool
+}
+
+type macroKey struct {
+	s    *String
+	mode evalMode
+}
+
+func (e *executor) mode() evalMode {
+	return evalMode{e.opts.Macros, e.seed, e.opts.Exact}
+}
+
+// compiled returns the directives dirs of the scope n, whose path is path,
+// compiled for x. The compilation is kept by the Program, if there is one.
+func (e *executor) compiled(n Node, dirs []Node, x interface{}, path string) *compiledScope {
+	t := reflect.TypeOf(x)
+	if e.prog == nil {
+		return compile(dirs, t, path)
+	}
+	key := scopeKey{n, t}
+	if c, ok := e.prog.scopes.Load(key); ok {
+		return c.(*compiledScope)
+	}
+	c, _ := e.prog.scopes.LoadOrStore(key, compile(dirs, t, path))
+	return c.(*compiledScope)
+}
+
+func compile(dirs []Node, t reflect.Type, path string) *compiledScope {
+	paths := NewBreadcrumbs(path, dirs)
+	c := &compiledScope{dirs: make([]compiledDirective, 0, len(dirs))}
+	for _, n := range dirs {
+		ident, isObject, ok := identify(n)
+		if !ok {
+			continue
+		}
+		d := compiledDirective{n: n, ident: ident, isObject: isObject}
+		var values []Node
+		switch n := n.(type) {
+		case *Directive:
+			values = []Node{n.Value}
+		case *RepeatedDirective:
+			values = n.Values
+		}
+		d.m, d.ok = lookup(t, d.ident)
+		d.paths = make([]string, len(values))
+		d.values = make([]reflect.Value, len(values))
+		for i, v := range values {
+			d.paths[i] = paths.Next(d.ident)
+			if d.ok {
+				d.values[i] = literal(d.m, v)
+			}
+		}
+		d.path = paths.Join(d.ident)
+		if _, ok := n.(*Directive); ok {
+			d.path = d.paths[0]
+		}
+		c.dirs = append(c.dirs, d)
+	}
+	return c
+}
+
+// literal converts the literal value v for m, or returns an invalid value
+// if v is not a literal or does not convert.
+func literal(m member, v Node) reflect.Value {
+	if m.Type == nil || (m.Kind != setterMethod && m.Kind != valueField && m.Kind != sliceField) {
+		return reflect.Value{}
+	}
+	var value string
+	switch v := v.(type) {
+	case *String:
+		if v.IsMacro {
+			return reflect.Value{}
+		}
+		value = v.Value
+	case *Number:
+		value = v.Value
+	case *Note:
+		value = v.Value
+	case *Unknown:
+		value = v.Value
+	default:
+		return reflect.Value{}
+	}
+	cv, err := convert(value, m.Type)
+	if err != nil {
+		return reflect.Value{}
+	}
+	return cv
+}
+
+// Compile prepares n for repeated execution.
+func Compile(n Node) *Program {
+	return &Program{node: n}
+}
+
+// Execute executes the program's node into x like ExecuteWith.
+func (p *Program) Execute(x interface{}, o Options) error {
+	return p.ExecuteContext(context.Background(), x, o)
+}
+
+// ExecuteContext executes the program's node into x like ExecuteContext.
+func (p *Program) ExecuteContext(ctx context.Context, x interface{}, o Options) error {
+	e := &executor{opts: o, ctx: ctx, prog: p}
+	if o.Atomic {
+		return e.runAtomic(p.node, x)
+	}
+	return e.run(p.node, x)
+}
+
+// maxCachedMacro is the longest expansion a Program keeps. Longer macros
+// are expanded again by every execution, so that they never have to be
+// held in memory.
+const maxCachedMacro = 1 << 12
+
+// macro streams the expansion of the macro s into x's setter for ident,
+// one value at a time. Values are set as they are computed, so a macro
+// that fails part way has set the values before the failure.
+func (e *executor) macro(x interface{}, ident string, s *String, path string) error {
+	max := e.opts.Limits.MaxMacroLength
+	key := macroKey{s, e.mode()}
+	if e.prog != nil {
+		if out, ok := e.prog.macros.Load(key); ok {
+			out := out.([]string)
+			if err := e.check(LimitMacroLength, len(out), max, s.Begin(), path); err != nil {
+				return err
+			}
+			for _, n := range out {
+				if err := e.set(x, ident, n, reflect.Value{}, s.Begin(), path); err != nil {
+					return err
+				}
+			}
+			return nil
+		}
+	}
+
+	expr, err := eval.Compile(s.Value, MacroOptions(e.opts, e.seed, path)...)
+	if err != nil {
+		return macroError(err, s, path, max)
+	}
+	var out []string
+	i := 0
+	st := expr.Stream(max)
+	for v := range st.All() {
+		n := fmt.Sprintf("%v", v)
+		if e.prog != nil && i < maxCachedMacro {
+			out = append(out, n)
+		}
+		if err = e.set(x, ident, n, reflect.Value{}, s.Begin(), path); err != nil {
+			return err
+		}
+		i++
+	}
+	if err := st.Err(); err != nil {
+		return macroError(err, s, path, max)
+	}
+	if e.prog != nil && i <= maxCachedMacro {
+		e.prog.macros.Store(key, out)
+	}
+	return nil
+}
+
+// macroError positions an error from evaluating the macro s. Syntax
+// errors point at the column inside the macro.
+func macroError(err error, s *String, path string, max int) error {
+	var lerr *eval.LengthError
+	if errors.As(err, &lerr) {
+		return &Error{Pos: s.Begin(), Path: path, Err: &LimitError{Limit: LimitMacroLength, Max: max}}
+	}
+	return &Error{Pos: MacroPos(s, err), Path: path, Err: err}
+}
+
+// MacroPos returns the position in the source of the problem err, an
+// error from evaluating the macro s, reports. Errors without a column are
+// positioned at s.
+func MacroPos(s *String, err error) Position {
+	pos := s.Begin()
+	var eerr *eval.Error
+	if errors.As(err, &eerr) {
+		// The macro's text starts after its opening backtick.
+		pos.Byte += eerr.Column
+		pos.Column += eerr.Column
+	}
+	return pos
+}
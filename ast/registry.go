@@ -0,0 +1,141 @@
+package ast
+
+import (
+	"fmt"
+	"reflect"
+	"sort"
+	"sync"
+)
+
+var (
+	registryMu sync.RWMutex
+	registry   = map[string]reflect.Value{}
+)
+
+// Register makes name available as a block kind. When an object directive
+// has no matching method or field on its target, the executor calls factory
+// to create the value, executes the block into it and stores it in the
+// target's first []T, map[string]T or map[string][]T field whose element
+// type T it implements.
+//
+// factory must be a function with no arguments and a single result.
+// Validate checks blocks against that result type without calling factory,
+// so blocks of factories that return an interface are not checked.
+// Register panics if factory is not such a function or name is already
+// registered.
+func Register(name string, factory interface{}) {
+	f := reflect.ValueOf(factory)
+	if f.Kind() != reflect.Func || f.Type().NumIn() != 0 || f.Type().NumOut() != 1 {
+		panic(fmt.Sprintf("ast: Register factory for %s must be a func() T, got %T", name, factory))
+	}
+
+	registryMu.Lock()
+	defer registryMu.Unlock()
+	if _, dup := registry[name]; dup {
+		panic("ast: Register called twice for " + name)
+	}
+	registry[name] = f
+}
+
+// Registered returns the sorted names of all registered block kinds.
+func Registered() []string {
+	registryMu.RLock()
+	defer registryMu.RUnlock()
+	names := make([]string, 0, len(registry))
+	for name := range registry {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func lookupKind(name string) (reflect.Value, bool) {
+	registryMu.RLock()
+	defer registryMu.RUnlock()
+	f, ok := registry[name]
+	return f, ok
+}
+
+// polymorphicElem returns the interface type of the blocks t holds if t
+// is a slice, string-keyed map or string-keyed map of slices of interface
+// values, or nil.
+func polymorphicElem(t reflect.Type) reflect.Type {
+	if t.Kind() == reflect.Map {
+		if t.Key().Kind() != reflect.String {
+			return nil
+		}
+		t = t.Elem()
+		if t.Kind() == reflect.Interface {
+			return t
+		}
+	}
+	if t.Kind() == reflect.Slice && t.Elem().Kind() == reflect.Interface {
+		return t.Elem()
+	}
+	return nil
+}
+
+func hasPolymorphicField(t reflect.Type) bool {
+	return acceptsKind(t, nil)
+}
+
+// acceptsKind reports whether t points to a struct with a polymorphic
+// field that can hold values of type y, or any such field if y is nil.
+func acceptsKind(t reflect.Type, y reflect.Type) bool {
+	if t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	if t.Kind() != reflect.Struct {
+		return false
+	}
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		if elem := polymorphicElem(f.Type); f.PkgPath == "" && elem != nil && (y == nil || y.Implements(elem)) {
+			return true
+		}
+	}
+	return false
+}
+
+// attach stores y in the first exported polymorphic field of x that
+// accepts it and returns the field's name. Maps are keyed by the block
+// kind: a map of slices appends to the kind's slice, and a map of single
+// values holds one block per kind, so a second block of the same kind is
+// an error.
+func attach(x interface{}, kind string, y interface{}) (string, error) {
+	v := reflect.Indirect(reflect.ValueOf(x))
+	yv := reflect.ValueOf(y)
+	if v.Kind() == reflect.Struct && v.CanSet() {
+		for i := 0; i < v.NumField(); i++ {
+			sf := v.Type().Field(i)
+			elem := polymorphicElem(sf.Type)
+			if sf.PkgPath != "" || elem == nil || !yv.Type().Implements(elem) {
+				continue
+			}
+
+			f := v.Field(i)
+			if f.Kind() == reflect.Slice {
+				f.Set(reflect.Append(f, yv))
+				return sf.Name, nil
+			}
+			if f.IsNil() {
+				f.Set(reflect.MakeMap(sf.Type))
+			}
+			key := reflect.ValueOf(kind).Convert(sf.Type.Key())
+			prev := f.MapIndex(key)
+			if sf.Type.Elem().Kind() == reflect.Slice {
+				if !prev.IsValid() {
+					prev = reflect.Zero(sf.Type.Elem())
+				}
+				f.SetMapIndex(key, reflect.Append(prev, yv))
+				return sf.Name, nil
+			}
+			if prev.IsValid() {
+				return "", fmt.Errorf("%T.%s already holds a block of kind %s", x, sf.Name, kind)
+			}
+			f.SetMapIndex(key, yv)
+			return sf.Name, nil
+		}
+	}
+	return "", fmt.Errorf("%T has no slice or map field that accepts block kind %s (%T)", x, kind, y)
+}
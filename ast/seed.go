@@ -0,0 +1,62 @@
+package ast
+
+import (
+	"fmt"
+	"hash/fnv"
+	"strconv"
+
+	"github.com/dianelooney/directive/eval"
+)
+
+// SeedDirective is the document-level directive that seeds the random
+// functions of macros, such as rand and chance, overriding Options.Seed:
+//
+//	Seed 42
+//
+// It is executed into targets that have a member for it like any other
+// directive, and skipped for targets that do not.
+const SeedDirective = "Seed"
+
+// Seed returns the directive that seeds the macros of n and its seed, or
+// nil if n is not a document or does not set one.
+func Seed(n Node) (*Directive, uint64, error) {
+	doc, ok := n.(*Document)
+	if !ok {
+		return nil, 0, nil
+	}
+	for _, dir := range doc.Directives {
+		d, ok := dir.(*Directive)
+		if !ok || d.Identifier != SeedDirective {
+			continue
+		}
+		if num, ok := d.Value.(*Number); ok {
+			if seed, err := strconv.ParseUint(num.Value, 10, 64); err == nil {
+				return d, seed, nil
+			}
+		}
+		err := fmt.Errorf("%s needs a whole number of at least 0, got %s", SeedDirective, d.Value.Text())
+		return d, 0, &Error{Pos: d.Value.Begin(), Path: SeedDirective, Err: err}
+	}
+	return nil, 0, nil
+}
+
+// MacroSeed returns the seed of the macro at path in a document seeded
+// with seed. Every macro draws its own numbers. They do not change when
+// directives are added elsewhere, but path includes the indexes of
+// repeated blocks, so inserting a block before others of the same kind
+// reseeds the macros of those after it.
+func MacroSeed(seed uint64, path string) uint64 {
+	h := fnv.New64a()
+	h.Write([]byte(path))
+	return seed ^ h.Sum64()
+}
+
+// MacroOptions returns the eval options of the macro at path, executed
+// with o into a document seeded with seed.
+func MacroOptions(o Options, seed uint64, path string) []eval.Option {
+	opts := []eval.Option{eval.WithRegistry(o.Macros), eval.WithSeed(MacroSeed(seed, path))}
+	if o.Exact {
+		opts = append(opts, eval.Exact())
+	}
+	return opts
+}
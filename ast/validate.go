@@ -0,0 +1,349 @@
+package ast
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+
+	"github.com/dianelooney/directive/eval"
+)
+
+// Diagnostic is a problem found in a document without executing it.
+type Diagnostic struct {
+	Pos     Position
+	Path    string
+	Message string
+}
+
+func (d Diagnostic) Error() string {
+	if d.Path == "" {
+		return fmt.Sprintf("%s: %s", d.Pos, d.Message)
+	}
+	return fmt.Sprintf("%s: %s: %s", d.Pos, d.Path, d.Message)
+}
+
+// Diagnostics is a list of problems, in document order.
+type Diagnostics []Diagnostic
+
+func (d Diagnostics) Error() string {
+	strs := make([]string, len(d))
+	for i, diag := range d {
+		strs[i] = diag.Error()
+	}
+	return strings.Join(strs, "\n")
+}
+
+// Validate checks n against the target type t using the same rules as
+// Execute, without calling any getter or setter. It reports unknown
+// directives, values that do not convert, blocks given where values are
+// expected and the reverse, repeated directives for single fields and
+// missing required fields.
+func Validate(n Node, t reflect.Type) Diagnostics {
+	return ValidateWith(n, t, Options{})
+}
+
+// ValidateWith is like Validate, but follows the policies of o for unknown
+// and duplicate directives and checks macros against the registry of
+// o.Macros. A SeedDirective is validated, and ignored for targets without
+// a member for it.
+func ValidateWith(n Node, t reflect.Type, o Options) Diagnostics {
+	v := validator{macros: o.Macros, unknowns: o.Unknown, dups: o.Duplicates}
+	switch d := n.(type) {
+	case *Document:
+		dir, _, err := Seed(d)
+		if err != nil {
+			v.report(dir.Value.Begin(), SeedDirective, "%v", errors.Unwrap(err))
+		}
+		v.seedDir = dir
+		v.scope(d.Directives, t, "", d.Begin())
+	case *Object:
+		v.scope(d.Directives, t, "", d.Begin())
+	default:
+		v.report(n.Begin(), "", "cannot validate %T", n)
+	}
+	sort.SliceStable(v.diags, func(i, j int) bool {
+		return v.diags[i].Pos.Byte < v.diags[j].Pos.Byte
+	})
+	return v.diags
+}
+
+type validator struct {
+	diags    Diagnostics
+	macros   *eval.Registry
+	unknowns UnknownPolicy
+	dups     DuplicatePolicy
+	seedDir  *Directive
+}
+
+func (v *validator) report(pos Position, path string, format string, args ...interface{}) {
+	v.diags = append(v.diags, Diagnostic{Pos: pos, Path: path, Message: fmt.Sprintf(format, args...)})
+}
+
+func (v *validator) scope(dirs []Node, t reflect.Type, path string, pos Position) {
+	paths := NewBreadcrumbs(path, dirs)
+	seen := map[string]Position{}
+	for _, n := range dirs {
+		switch d := n.(type) {
+		case *Directive:
+			p := paths.Next(d.Identifier)
+			m, ok := lookup(t, d.Identifier)
+			if d == v.seedDir && !ok {
+				continue
+			}
+			v.duplicate(m, ok, d.Identifier, seen, d.Begin(), p)
+			if o, isObject := d.Value.(*Object); isObject {
+				v.object(t, m, ok, d.Identifier, o, p, d.Begin())
+			} else if !ok {
+				v.unknown(t, d.Identifier, p, d.Begin())
+			} else {
+				v.value(m, d.Value, p)
+			}
+		case *RepeatedDirective:
+			m, ok := lookup(t, d.Identifier)
+			dup := v.duplicate(m, ok, d.Identifier, seen, d.Begin(), paths.Join(d.Identifier))
+			if !ok && !hasObject(d.Values) {
+				v.unknown(t, d.Identifier, paths.Join(d.Identifier), d.Begin())
+				continue
+			}
+			if ok && !dup && !m.Repeatable() && !v.overwrites(m) {
+				v.report(d.Begin(), paths.Join(d.Identifier), "%s takes a single value and cannot be repeated", d.Identifier)
+			}
+			for _, value := range d.Values {
+				p := paths.Next(d.Identifier)
+				if o, isObject := value.(*Object); isObject {
+					v.object(t, m, ok, d.Identifier, o, p, value.Begin())
+				} else if !ok {
+					v.unknown(t, d.Identifier, p, value.Begin())
+				} else {
+					v.value(m, value, p)
+				}
+			}
+		}
+	}
+
+	for _, m := range members(t) {
+		if _, ok := seen[m.Name]; m.Required && m.Default == nil && !ok {
+			v.report(pos, path, "missing required directive %s", m.Name)
+		}
+	}
+}
+
+// duplicate records an occurrence of ident and reports it if the field it
+// sets was already set in the scope and its duplicate policy does not
+// allow that. It returns whether it reported the occurrence.
+func (v *validator) duplicate(m member, ok bool, ident string, seen map[string]Position, pos Position, path string) bool {
+	prev, dup := seen[ident]
+	if !dup {
+		seen[ident] = pos
+		return false
+	}
+	if !ok || (m.Kind != valueField && m.Kind != sliceField) {
+		return false
+	}
+	switch m.policy(v.dups) {
+	case DuplicateError:
+	case DuplicateDefault:
+		if m.Kind == sliceField {
+			return false
+		}
+	default:
+		return false
+	}
+	v.report(pos, path, "%s is set more than once; first set at %s", ident, prev)
+	return true
+}
+
+// overwrites reports whether m is a scalar field whose duplicate policy
+// says which of several values it keeps.
+func (v *validator) overwrites(m member) bool {
+	switch m.policy(v.dups) {
+	case DuplicateLast, DuplicateFirst, DuplicateAppend:
+		return m.Kind == valueField
+	}
+	return false
+}
+
+func (v *validator) object(t reflect.Type, m member, ok bool, ident string, o *Object, path string, pos Position) {
+	if ok && !m.Object() {
+		v.report(pos, path, "%s expects a value, not a block", ident)
+		return
+	}
+	if ok {
+		if m.Type.Kind() != reflect.Interface {
+			v.scope(o.Directives, m.Type, path, o.Begin())
+		}
+		return
+	}
+
+	f, registered := lookupKind(ident)
+	if !registered || !acceptsKind(t, f.Type().Out(0)) {
+		v.unknown(t, ident, path, pos)
+		return
+	}
+	// The factory is not called, so the contents of kinds it returns as an
+	// interface cannot be checked.
+	if out := f.Type().Out(0); out.Kind() != reflect.Interface {
+		v.scope(o.Directives, out, path, o.Begin())
+	}
+}
+
+func (v *validator) value(m member, n Node, path string) {
+	if m.Object() {
+		v.report(n.Begin(), path, "%s expects a block, not %s", m.Name, n.Text())
+		return
+	}
+	if m.Type == nil {
+		return
+	}
+
+	var value string
+	switch n := n.(type) {
+	case *String:
+		if n.IsMacro {
+			// Execute sets each number of the macro as if it were written out.
+			if _, err := convert("0", m.Type); err != nil {
+				v.report(n.Begin(), path, "cannot use macro %s as %s", n.Text(), m.Type)
+			} else if _, err := eval.Compile(n.Value, eval.WithRegistry(v.macros)); err != nil {
+				v.report(MacroPos(n, err), path, "invalid macro %s: %v", n.Text(), err)
+			}
+			return
+		}
+		value = n.Value
+	case *Number:
+		value = n.Value
+	case *Note:
+		value = n.Value
+	case *Unknown:
+		value = n.Value
+	default:
+		return
+	}
+	cv, err := convert(value, m.Type)
+	if err != nil {
+		v.report(n.Begin(), path, "cannot use %s as %s for %s", n.Text(), m.Type, m.Name)
+		return
+	}
+	if m.Kind == valueField || m.Kind == sliceField {
+		if err := m.check(cv); err != nil {
+			v.report(n.Begin(), path, "%v", err)
+		}
+	}
+}
+
+// unknown reports a directive t has no member for, unless the unknown
+// directive policy skips it or t collects it.
+func (v *validator) unknown(t reflect.Type, ident string, path string, pos Position) {
+	switch v.unknowns {
+	case UnknownSkip:
+		return
+	case UnknownCollect:
+		if _, ok := remain(t); ok {
+			return
+		}
+	}
+
+	var names []string
+	for _, m := range members(t) {
+		names = append(names, m.Name)
+	}
+	if hasPolymorphicField(t) {
+		names = append(names, Registered()...)
+	}
+
+	if s := Suggest(ident, names); s != "" {
+		v.report(pos, path, "unknown directive %s for %s; did you mean %s?", ident, t, s)
+	} else {
+		v.report(pos, path, "unknown directive %s for %s", ident, t)
+	}
+}
+
+func hasObject(values []Node) bool {
+	for _, v := range values {
+		if _, ok := v.(*Object); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// Breadcrumbs builds paths such as Kit[1].Loop.Measure.Pulse[2] for the
+// directives of one scope. An identifier gets a zero-based index only when
+// it has more than one value in the scope.
+type Breadcrumbs struct {
+	prefix string
+	total  map[string]int
+	seen   map[string]int
+}
+
+// NewBreadcrumbs returns the paths of dirs, which are nested under prefix.
+func NewBreadcrumbs(prefix string, dirs []Node) *Breadcrumbs {
+	p := &Breadcrumbs{prefix: prefix, total: map[string]int{}, seen: map[string]int{}}
+	for _, n := range dirs {
+		switch d := n.(type) {
+		case *Directive:
+			p.total[d.Identifier]++
+		case *RepeatedDirective:
+			p.total[d.Identifier] += len(d.Values)
+		}
+	}
+	return p
+}
+
+// Join returns the path of ident without an index.
+func (p *Breadcrumbs) Join(ident string) string {
+	return join(p.prefix, ident)
+}
+
+func join(prefix, ident string) string {
+	if prefix == "" {
+		return ident
+	}
+	return prefix + "." + ident
+}
+
+// Next returns the path of the next value for ident.
+func (p *Breadcrumbs) Next(ident string) string {
+	i := p.seen[ident]
+	p.seen[ident]++
+	if p.total[ident] <= 1 {
+		return p.Join(ident)
+	}
+	return fmt.Sprintf("%s[%d]", p.Join(ident), i)
+}
+
+// Suggest returns the candidate closest to name, if any is close enough to
+// be a likely typo.
+func Suggest(name string, candidates []string) string {
+	best, bestDist := "", len(name)/2+1
+	for _, c := range candidates {
+		if strings.EqualFold(c, name) {
+			return c
+		}
+		if d := levenshtein(strings.ToLower(name), strings.ToLower(c)); d < bestDist {
+			best, bestDist = c, d
+		}
+	}
+	return best
+}
+
+func levenshtein(a, b string) int {
+	prev := make([]int, len(b)+1)
+	cur := make([]int, len(b)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+	for i := 1; i <= len(a); i++ {
+		cur[0] = i
+		for j := 1; j <= len(b); j++ {
+			cost := 1
+			if a[i-1] == b[j-1] {
+				cost = 0
+			}
+			cur[j] = min(prev[j]+1, cur[j-1]+1, prev[j-1]+cost)
+		}
+		prev, cur = cur, prev
+	}
+	return prev[len(b)]
+}
@@ -0,0 +1,55 @@
+package directive_test
+
+import (
+	"testing"
+
+	"github.com/dianelooney/directive"
+	"github.com/dianelooney/directive/ast"
+)
+
+const benchSong = `
+Tempo 120
+Title "carrot"
+[Sample "808s_2" "hihats_1"]
+Kit {
+	Volume 0.5
+	[Pulse 1 2 3 4 ` + "`0 % 0.25 0 4`" + `]
+}
+Kit {
+	Volume 0.25
+	[Pulse 1.5 2.5 3.5 4.5]
+}
+`
+
+// BenchmarkExecute_Interpreted compiles each scope of the document for its
+// target type on every execution.
+func BenchmarkExecute_Interpreted(b *testing.B) {
+	doc, err := ast.NewParser([]byte(benchSong)).Parse()
+	if err != nil {
+		b.Fatal(err)
+	}
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if err := doc.Execute(&song{}); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// BenchmarkExecute_Prepared reuses the compiled scopes and short macro
+// expansions of a prepared document. Both benchmarks share the per-type
+// member cache.
+func BenchmarkExecute_Prepared(b *testing.B) {
+	e, err := directive.Prepare([]byte(benchSong))
+	if err != nil {
+		b.Fatal(err)
+	}
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if err := e.Execute(&song{}); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
@@ -0,0 +1,274 @@
+package directive
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/dianelooney/directive/ast"
+	"github.com/dianelooney/directive/eval"
+)
+
+// DecodeMap parses data into a generic tree without needing a Go type.
+//
+// Scalar directives become values, objects become nested maps, and repeated
+// directives (or a scalar directive that appears more than once) become
+// slices. Number literals are float64 unless UseNumber is given, strings and
+// notes are strings, and `?` is nil. The result can be passed straight to
+// encoding/json.
+func DecodeMap(data []byte, opts ...Option) (map[string]interface{}, error) {
+	c := newConfig(opts)
+	doc, err := c.parse(data)
+	if err != nil {
+		return nil, err
+	}
+	return (&decoder{cfg: c}).decodeMap(doc, "")
+}
+
+// decoder builds generic trees. With plan set it also records the
+// operations it performs, for Executer.Plan.
+type decoder struct {
+	cfg  *config
+	plan bool
+	ops  []ast.Operation
+
+	// ctx and the counters below enforce the context and ast.Limits the
+	// same way ast.ExecuteContext does.
+	ctx   context.Context
+	depth int
+	nodes int
+	sets  int
+
+	// seed seeds the macros, see ast.SeedDirective.
+	seed uint64
+}
+
+// count checks the context and counts a directive or value against the
+// node limit.
+func (dec *decoder) count(pos ast.Position, path string) error {
+	if dec.ctx != nil {
+		if err := dec.ctx.Err(); err != nil {
+			return &ast.Error{Pos: pos, Path: path, Err: err}
+		}
+	}
+	dec.nodes++
+	return limit(ast.LimitNodes, dec.nodes, dec.cfg.exec.Limits.MaxNodes, pos, path)
+}
+
+// doneEvery is how many values are decoded between checks of the context.
+const doneEvery = 1 << 10
+
+// set counts a value against the set limit, and checks the context every
+// doneEvery values so that a long macro stops soon after it is done.
+func (dec *decoder) set(pos ast.Position, path string) error {
+	dec.sets++
+	if dec.ctx != nil && dec.sets%doneEvery == 0 {
+		if err := dec.ctx.Err(); err != nil {
+			return &ast.Error{Pos: pos, Path: path, Err: err}
+		}
+	}
+	return limit(ast.LimitSets, dec.sets, dec.cfg.exec.Limits.MaxSets, pos, path)
+}
+
+// macro streams the expansion of the macro s into m as values of ident.
+func (dec *decoder) macro(m genericMap, ident string, s *ast.String, path string) error {
+	max := dec.cfg.exec.Limits.MaxMacroLength
+	expr, err := eval.Compile(s.Value, ast.MacroOptions(dec.cfg.exec, dec.seed, path)...)
+	if err != nil {
+		return &ast.Error{Pos: ast.MacroPos(s, err), Path: path, Err: err}
+	}
+	st := expr.Stream(max)
+	for f := range st.All() {
+		if err := dec.set(s.Begin(), path); err != nil {
+			return err
+		}
+		m.add(ident, decodeFloat(f, dec.cfg), s.Begin(), path)
+	}
+	var lerr *eval.LengthError
+	if err := st.Err(); errors.As(err, &lerr) {
+		return &ast.Error{Pos: s.Begin(), Path: path, Err: &ast.LimitError{Limit: ast.LimitMacroLength, Max: max}}
+	} else if err != nil {
+		return &ast.Error{Pos: ast.MacroPos(s, err), Path: path, Err: err}
+	}
+	return nil
+}
+
+func limit(l ast.Limit, n, max int, pos ast.Position, path string) error {
+	if max > 0 && n > max {
+		return &ast.Error{Pos: pos, Path: path, Err: &ast.LimitError{Limit: l, Max: max}}
+	}
+	return nil
+}
+
+func (dec *decoder) decodeMap(n ast.Node, path string) (map[string]interface{}, error) {
+	var directives []ast.Node
+	switch v := n.(type) {
+	case *ast.Document:
+		directives = v.Directives
+		dec.seed = dec.cfg.exec.Seed
+		if dir, seed, err := ast.Seed(v); err != nil {
+			return nil, err
+		} else if dir != nil {
+			dec.seed = seed
+		}
+	case *ast.Object:
+		directives = v.Directives
+	default:
+		return nil, fmt.Errorf("directive: cannot decode %T into a map", n)
+	}
+
+	m := genericMap{dec: dec, values: map[string]interface{}{}, lists: map[string]bool{}}
+	paths := ast.NewBreadcrumbs(path, directives)
+	for _, dir := range directives {
+		switch d := dir.(type) {
+		case *ast.Directive:
+			p := paths.Next(d.Identifier)
+			if err := dec.count(d.Begin(), p); err != nil {
+				return nil, err
+			}
+			v, err := dec.decodeValue(d.Value, p)
+			if err != nil {
+				return nil, positioned(err, d.Value.Begin(), p)
+			}
+			if err := dec.set(d.Value.Begin(), p); err != nil {
+				return nil, err
+			}
+			m.add(d.Identifier, v, d.Value.Begin(), p)
+		case *ast.RepeatedDirective:
+			if err := dec.count(d.Begin(), paths.Join(d.Identifier)); err != nil {
+				return nil, err
+			}
+			m.list(d.Identifier)
+			for _, value := range d.Values {
+				p := paths.Next(d.Identifier)
+				if err := dec.count(value.Begin(), p); err != nil {
+					return nil, err
+				}
+				if s, ok := value.(*ast.String); ok && s.IsMacro {
+					if err := dec.macro(m, d.Identifier, s, p); err != nil {
+						return nil, err
+					}
+					continue
+				}
+				v, err := dec.decodeValue(value, p)
+				if err != nil {
+					return nil, positioned(err, value.Begin(), p)
+				}
+				if err := dec.set(value.Begin(), p); err != nil {
+					return nil, err
+				}
+				m.add(d.Identifier, v, value.Begin(), p)
+			}
+		}
+	}
+	return m.values, nil
+}
+
+// positioned wraps err in an *ast.Error at pos and path unless it already
+// has a position.
+func positioned(err error, pos ast.Position, path string) error {
+	var xerr *ast.Error
+	if errors.As(err, &xerr) {
+		return err
+	}
+	return &ast.Error{Pos: pos, Path: path, Err: err}
+}
+
+func (dec *decoder) decodeValue(n ast.Node, path string) (interface{}, error) {
+	c := dec.cfg
+	switch v := n.(type) {
+	case *ast.Object:
+		if dec.plan {
+			dec.ops = append(dec.ops, ast.Operation{Kind: ast.OpCreate, Path: path, Pos: v.Begin(), Member: "map[string]interface {}"})
+		}
+		dec.depth++
+		defer func() { dec.depth-- }()
+		if err := limit(ast.LimitDepth, dec.depth, c.exec.Limits.MaxDepth, v.Begin(), path); err != nil {
+			return nil, err
+		}
+		return dec.decodeMap(v, path)
+	case *ast.String:
+		return v.Value, nil
+	case *ast.Number:
+		if c.useNumber {
+			return jsonNumber(v.Value), nil
+		}
+		f, err := strconv.ParseFloat(v.Value, 64)
+		if err != nil {
+			return nil, err
+		}
+		return f, nil
+	case *ast.Note:
+		return v.Value, nil
+	case *ast.Unknown:
+		return nil, nil
+	}
+	return nil, fmt.Errorf("unhandled value type %T", n)
+}
+
+func decodeFloat(f float64, c *config) interface{} {
+	if c.useNumber {
+		return json.Number(strconv.FormatFloat(f, 'g', -1, 64))
+	}
+	return f
+}
+
+// jsonNumber normalizes a number literal into a form encoding/json accepts,
+// keeping its significant digits intact: "+007." becomes "7" and "-00.50"
+// becomes "-0.50".
+func jsonNumber(s string) json.Number {
+	sign := ""
+	if strings.HasPrefix(s, "-") {
+		sign = "-"
+	}
+	s = strings.TrimLeft(s, "+-")
+	s = strings.TrimSuffix(s, ".")
+	s = strings.TrimLeft(s, "0")
+	if s == "" || s[0] == '.' {
+		s = "0" + s
+	}
+	return json.Number(sign + s)
+}
+
+// genericMap collects the directives of one scope, promoting an identifier
+// to a slice once it is repeated.
+type genericMap struct {
+	dec    *decoder
+	values map[string]interface{}
+	lists  map[string]bool
+}
+
+func (m genericMap) list(key string) {
+	if m.lists[key] {
+		return
+	}
+	m.lists[key] = true
+	if v, ok := m.values[key]; ok {
+		m.values[key] = []interface{}{v}
+	} else {
+		m.values[key] = []interface{}{}
+	}
+}
+
+func (m genericMap) add(key string, v interface{}, pos ast.Position, path string) {
+	kind := ast.OpSet
+	if _, ok := m.values[key]; ok && !m.lists[key] {
+		m.list(key)
+	}
+	if m.lists[key] {
+		kind = ast.OpAppend
+		m.values[key] = append(m.values[key].([]interface{}), v)
+	} else {
+		m.values[key] = v
+	}
+
+	if m.dec.plan {
+		if _, ok := v.(map[string]interface{}); ok {
+			v = nil
+		}
+		m.dec.ops = append(m.dec.ops, ast.Operation{Kind: kind, Path: path, Pos: pos, Member: fmt.Sprintf("map[string]interface {}[%q]", key), Value: v})
+	}
+}
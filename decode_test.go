@@ -0,0 +1,82 @@
+package directive_test
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/dianelooney/directive"
+)
+
+const songDoc = `
+Tempo 120
+Name "carrot"
+[Sample "808s_2" "hihats_1"]
+Kit { Volume 0.5 }
+Kit {
+	Volume 1.
+	[Pulse ` + "`0 * 2`" + ` 3]
+}
+`
+
+func TestDecodeMap(t *testing.T) {
+	m, err := directive.DecodeMap([]byte(songDoc))
+	if err != nil {
+		t.Fatalf("DecodeMap returned an error: %v", err)
+	}
+
+	data, err := json.Marshal(m)
+	if err != nil {
+		t.Fatalf("json.Marshal returned an error: %v", err)
+	}
+	const expected = `{"Kit":[{"Volume":0.5},{"Pulse":[0,0,3],"Volume":1}],"Name":"carrot","Sample":["808s_2","hihats_1"],"Tempo":120}`
+	if string(data) != expected {
+		t.Errorf("Expected %s but got %s", expected, data)
+	}
+}
+
+func TestDecodeMap_UseNumber(t *testing.T) {
+	m, err := directive.DecodeMap([]byte(`Tempo +120 Volume 0.10`), directive.UseNumber())
+	if err != nil {
+		t.Fatalf("DecodeMap returned an error: %v", err)
+	}
+
+	if m["Tempo"] != json.Number("120") {
+		t.Errorf("Expected Tempo to be json.Number 120 but got %#v", m["Tempo"])
+	}
+	if m["Volume"] != json.Number("0.10") {
+		t.Errorf("Expected Volume to be json.Number 0.10 but got %#v", m["Volume"])
+	}
+}
+
+func TestDecodeMap_UseNumberJSON(t *testing.T) {
+	m, err := directive.DecodeMap([]byte(`A 007 B -00.50 C +0 D 10.`), directive.UseNumber())
+	if err != nil {
+		t.Fatalf("DecodeMap returned an error: %v", err)
+	}
+
+	data, err := json.Marshal(m)
+	if err != nil {
+		t.Fatalf("json.Marshal returned an error: %v", err)
+	}
+	const expected = `{"A":7,"B":-0.50,"C":0,"D":10}`
+	if string(data) != expected {
+		t.Errorf("Expected %s but got %s", expected, data)
+	}
+	var back map[string]interface{}
+	if err := json.Unmarshal(data, &back); err != nil {
+		t.Errorf("json.Unmarshal returned an error: %v", err)
+	}
+}
+
+func TestExecute_Interface(t *testing.T) {
+	var v interface{}
+	err := directive.Execute([]byte(`Tempo 120`), &v)
+	if err != nil {
+		t.Fatalf("Execute returned an error: %v", err)
+	}
+
+	m, ok := v.(map[string]interface{})
+	if !ok || m["Tempo"] != 120.0 {
+		t.Errorf("Expected map with Tempo 120 but got %#v", v)
+	}
+}
@@ -1,27 +1,35 @@
 package directive
 
 import (
+	"context"
 	"fmt"
 
 	"github.com/dianelooney/directive/ast"
-	"github.com/dianelooney/directive/format"
 )
 
+// Executer is a prepared document. It is safe for concurrent use by
+// multiple goroutines, as long as each call executes into its own target.
 type Executer interface {
 	Execute(target interface{}) (err error)
+	// ExecuteContext is like Execute, but stops with ctx's error once ctx
+	// is done.
+	ExecuteContext(ctx context.Context, target interface{}) (err error)
+	// Plan lists the operations Execute would perform on target, in order,
+	// without performing them. See ast.Plan.
+	Plan(target interface{}) ([]ast.Operation, error)
 }
 
-func Execute(data []byte, target interface{}) (err error) {
-	e, err := Prepare(data)
+func Execute(data []byte, target interface{}, opts ...Option) (err error) {
+	e, err := Prepare(data, opts...)
 	if err != nil {
 		return err
 	}
 	return e.Execute(target)
 }
 
-func Prepare(data []byte) (e Executer, err error) {
-	p := ast.NewParser(data)
-	doc, err := p.Parse()
+func Prepare(data []byte, opts ...Option) (e Executer, err error) {
+	c := newConfig(opts)
+	doc, err := c.parse(data)
 	if err != nil {
 		return nil, err
 	}
@@ -31,14 +39,49 @@ func Prepare(data []byte) (e Executer, err error) {
 		return nil, fmt.Errorf("directive internal error: Parse didn't return a document")
 	}
 
-	return exeggutor{d}, nil
+	return exeggutor{d, ast.Compile(d), c}, nil
 }
 
+// exeggutor is a prepared document. Executing it more than once reuses the
+// macro expansions and value conversions of earlier executions.
 type exeggutor struct {
-	doc *ast.Document
+	doc  *ast.Document
+	prog *ast.Program
+	cfg  *config
 }
 
 func (e exeggutor) Execute(target interface{}) (err error) {
-	format.PrettyPrint(e.doc)
-	return e.doc.Execute(target)
+	return e.ExecuteContext(context.Background(), target)
+}
+
+func (e exeggutor) ExecuteContext(ctx context.Context, target interface{}) (err error) {
+	switch t := target.(type) {
+	case *interface{}:
+		m, err := (&decoder{cfg: e.cfg, ctx: ctx}).decodeMap(e.doc, "")
+		if err != nil {
+			return err
+		}
+		*t = m
+		return nil
+	case *map[string]interface{}:
+		m, err := (&decoder{cfg: e.cfg, ctx: ctx}).decodeMap(e.doc, "")
+		if err != nil {
+			return err
+		}
+		*t = m
+		return nil
+	}
+
+	return e.prog.ExecuteContext(ctx, target, e.cfg.exec)
+}
+
+func (e exeggutor) Plan(target interface{}) ([]ast.Operation, error) {
+	switch target.(type) {
+	case *interface{}, *map[string]interface{}:
+		dec := &decoder{cfg: e.cfg, plan: true}
+		_, err := dec.decodeMap(e.doc, "")
+		return dec.ops, err
+	}
+
+	return ast.Plan(e.doc, target, e.cfg.exec)
 }
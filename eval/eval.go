@@ -1,136 +1,433 @@
 package eval
 
 import (
-	"regexp"
+	"fmt"
 	"strconv"
 	"strings"
 )
 
 type Token string
 
+// Evaluate evaluates t. It panics if t is not a number or fraction; use
+// Compile and Expr.Eval to get an error instead.
 func (t Token) Evaluate() (out []float64) {
-	v, _ := strconv.ParseFloat(string(t), 64)
+	v, err := t.float()
+	if err != nil {
+		panic(err)
+	}
 	return []float64{v}
 }
 
-func Eval(s string) (out []float64) {
-	tkns := Tokenize(s)
-	p := Parser{
-		tkns: tkns,
+// float parses t, a number such as 0.5 or a fraction such as 1/3.
+func (t Token) float() (float64, error) {
+	s := string(t)
+	if idx := strings.Index(s, "/"); idx >= 0 {
+		num, err1 := strconv.ParseFloat(s[:idx], 64)
+		den, err2 := strconv.ParseFloat(s[idx+1:], 64)
+		if err1 != nil || err2 != nil {
+			return 0, fmt.Errorf("invalid fraction %s", s)
+		}
+		if den == 0 {
+			return 0, fmt.Errorf("division by zero in %s", s)
+		}
+		return num / den, nil
+	}
+	f, err := strconv.ParseFloat(s, 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid number %s", s)
+	}
+	return f, nil
+}
+
+// Eval evaluates the macro expression s. It panics if s is malformed or
+// cannot be evaluated; use EvalE to get an error instead.
+func Eval(s string, opts ...Option) (out []float64) {
+	out, err := EvalE(s, opts...)
+	if err != nil {
+		panic(err)
 	}
-	return p.Parse().Evaluate()
+	return out
+}
+
+// EvalE evaluates the macro expression s.
+func EvalE(s string, opts ...Option) ([]float64, error) {
+	return EvalMax(s, 0, opts...)
+}
+
+// EvalMax is like EvalE, but stops with a *LengthError as soon as the
+// expression, or any part of it, expands to more than max values.
+func EvalMax(s string, max int, opts ...Option) ([]float64, error) {
+	e, err := Compile(s, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return e.EvalMax(max)
+}
+
+// Expr is a compiled macro expression. It is safe for concurrent use.
+type Expr struct {
+	src   string
+	root  Node
+	seed  uint64
+	exact bool
+}
+
+// Compile parses s into an expression that can be evaluated repeatedly.
+// Malformed input is reported as an *Error with the column it starts at.
+// Operators and functions are resolved when s is compiled, so registering
+// more later does not change e.
+func Compile(s string, opts ...Option) (*Expr, error) {
+	o := newOptions(opts)
+	tkns, err := lex(s, o.reg)
+	if err != nil {
+		return nil, err
+	}
+	p := Parser{tkns: tkns, reg: o.reg}
+	root, err := p.parse()
+	if err != nil {
+		return nil, err
+	}
+	return &Expr{src: s, root: root, seed: o.seed, exact: o.exact}, nil
+}
+
+// Eval evaluates e. The random functions start from e's seed every time,
+// so e always evaluates to the same values.
+func (e *Expr) Eval() ([]float64, error) {
+	return e.EvalMax(0)
+}
+
+// EvalMax is like Eval, but stops with a *LengthError as soon as e, or
+// any part of it, expands to more than max values.
+func (e *Expr) EvalMax(max int) ([]float64, error) {
+	if e.exact {
+		out, err := evaluateRat(e.root, newScope(max, e.seed))
+		if err != nil {
+			return nil, err
+		}
+		return floats(out), nil
+	}
+	return collect(e.root, newScope(max, e.seed))
+}
+
+func (e *Expr) String() string {
+	return e.src
 }
 
-var symbols = []string{
-	`+`,
-	`-`,
-	`&`,
-	`|`,
-	`%`,
-	//`<`,
-	//`>`,
-	`\`,
-	//`…`,
-	`(`,
-	`)`,
-	`*`,
+// Error is a malformed expression, or one that cannot be evaluated.
+// Column is the one-based byte column of the problem in the source.
+type Error struct {
+	Column int
+	Msg    string
 }
-var tkn = regexp.MustCompile(`(?:[0-9]+/[0-9]+)|(?:-?[0-9]+(?:\.[0-9]*)?)|x|\` + strings.Join(symbols, `|\`))
 
+func (e *Error) Error() string {
+	return fmt.Sprintf("column %d: %s", e.Column, e.Msg)
+}
+
+func errorAt(col int, format string, args ...interface{}) error {
+	return &Error{Column: col, Msg: fmt.Sprintf(format, args...)}
+}
+
+// wrap positions err, an error from an operator or function, at col.
+// Errors that already have a column, and length errors, are kept as they
+// are.
+func wrap(col int, err error) error {
+	switch err.(type) {
+	case nil, *Error, *LengthError:
+		return err
+	}
+	return errorAt(col, "%v", err)
+}
+
+// Tokenize splits s into the tokens of the default registry, skipping
+// anything else.
 func Tokenize(s string) []Token {
-	tkns := tkn.FindAllString(s, -1)
-	out := make([]Token, len(tkns))
-	for i, t := range tkns {
-		out[i] = Token(t)
+	var out []Token
+	tkn := defaultRegistry.tokenizer()
+	for i := 0; i < len(s); {
+		loc := tkn.FindStringIndex(s[i:])
+		if loc == nil {
+			i++
+			continue
+		}
+		out = append(out, Token(s[i:i+loc[1]]))
+		i += loc[1]
 	}
 	return out
 }
 
-type Parser struct {
-	tkns []Token
+// token is a Token and the one-based column it starts at.
+type token struct {
+	tok Token
+	col int
+	// unary is set for a - that negates the operand it is attached to.
+	unary bool
 }
 
-func (p *Parser) Parse() Node {
-	var nodes []Node
-	for {
-		if len(p.tkns) == 0 {
-			break
+// lex is like Tokenize, but keeps columns and rejects anything between
+// tokens other than white space.
+//
+// A - is unary when it is attached to the operand after it and either
+// starts the expression, follows white space or follows another operator
+// or (. So "2 -1" is the list 2, -1 while "2 - 1" and "2-1" subtract.
+func lex(s string, reg *Registry) ([]token, error) {
+	var out []token
+	tkn := reg.tokenizer()
+	for i := 0; i < len(s); {
+		if space(s[i]) {
+			i++
+			continue
 		}
-		t := p.tkns[0]
-		if t == "(" {
-			c := p.parseGroup()
-			nodes = append(nodes, c)
-		} else {
-			tok := p.parseAny()
-			nodes = append(nodes, tok)
+		loc := tkn.FindStringIndex(s[i:])
+		if loc == nil {
+			return nil, errorAt(i+1, "unexpected %q", strings.Fields(s[i:])[0])
+		}
+		end := i + loc[1]
+		// "0..4" is 0 .. 4, not 0. followed by a lone dot.
+		if s[end-1] == '.' && end < len(s) && s[end] == '.' && end-1 > i {
+			end--
 		}
+		t := token{tok: Token(s[i:end]), col: i + 1}
+		if t.tok == "-" && end < len(s) && !space(s[end]) {
+			t.unary = i == 0 || space(s[i-1]) || (len(out) > 0 && !operand(out[len(out)-1]) && out[len(out)-1].tok != ")")
+		}
+		out = append(out, t)
+		i = end
 	}
+	return out, nil
+}
 
-	return compact(nodes)
+func space(c byte) bool {
+	return c == ' ' || c == '\t' || c == '\r' || c == '\n'
+}
+
+// operand reports whether t starts an operand: a number, x, a function
+// call, a group or a negated operand.
+func operand(t token) bool {
+	if t.unary || t.tok == "(" {
+		return true
+	}
+	c := t.tok[0]
+	return c >= '0' && c <= '9' || name(t) && t.tok != "step"
 }
 
-func compact(in []Node) (out Node) {
-	for _, ops := range order {
-		for i, n := range in {
-			t, ok := n.(Token)
-			if !ok {
-				continue
+// name reports whether t is an identifier.
+func name(t token) bool {
+	c := t.tok[0]
+	return c == '_' || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z'
+}
+
+// Parser builds the tree of an expression from its tokens. It is a Pratt
+// parser: binary operators bind by their power in the registry and
+// associate as they were registered, and operands written next to each
+// other form a List.
+type Parser struct {
+	tkns []token
+	// reg resolves operators and functions. Nil is the default registry.
+	reg *Registry
+	// bound is set inside the right side of a mapping, where x may be
+	// used.
+	bound bool
+}
+
+// Parse returns the tree of the parser's tokens. It panics if they are
+// malformed; use Compile to get an error instead.
+func (p *Parser) Parse() Node {
+	n, err := p.parse()
+	if err != nil {
+		panic(err)
+	}
+	return n
+}
+
+func (p *Parser) parse() (Node, error) {
+	if p.reg == nil {
+		p.reg = defaultRegistry
+	}
+	if len(p.tkns) == 0 {
+		return &List{}, nil
+	}
+	n, err := p.expr(0)
+	if err != nil {
+		return nil, err
+	}
+	if len(p.tkns) > 0 {
+		return nil, errorAt(p.tkns[0].col, "unexpected %s", p.tkns[0].tok)
+	}
+	return n, nil
+}
+
+// expr parses an expression whose operators bind tighter than min.
+func (p *Parser) expr(min int) (Node, error) {
+	left, err := p.operand()
+	if err != nil {
+		return nil, err
+	}
+
+	for len(p.tkns) > 0 {
+		t := p.tkns[0]
+		if operand(t) {
+			if listPower <= min {
+				break
 			}
-			if !ops[string(t)] {
-				continue
+			right, err := p.expr(listPower)
+			if err != nil {
+				return nil, err
 			}
-
-			lhs := in[:i]
-			rhs := in[i+1:]
-			oper := Operator{
-				Op:  t,
-				LHS: compact(lhs),
-				RHS: compact(rhs),
+			if l, ok := left.(*List); ok {
+				l.Nums = append(l.Nums, right)
+			} else {
+				left = &List{Nums: []Node{left, right}}
 			}
-			return &oper
+			continue
 		}
-	}
-	list := make([]Node, len(in))
-	for i, n := range in {
-		if tok, ok := n.(Token); ok {
-			list[i] = &Value{Tok: tok}
+
+		op, ok := p.reg.operator(string(t.tok))
+		if !ok || op.power <= min {
+			break
+		}
+		p.tkns = p.tkns[1:]
+		if len(p.tkns) == 0 || !operand(p.tkns[0]) {
+			return nil, errorAt(t.col, "missing right operand for %s", t.tok)
+		}
+
+		bound := p.bound
+		p.bound = bound || t.tok == ":"
+		power := op.power
+		if op.assoc == Right {
+			power--
 		}
-		if grp, ok := n.(*Group); ok {
-			list[i] = grp
+		right, err := p.expr(power)
+		p.bound = bound
+		if err != nil {
+			return nil, err
+		}
+		if left, err = combine(t, op, left, right); err != nil {
+			return nil, err
 		}
 	}
-	return &List{Nums: list}
+	return left, nil
 }
 
-func (p *Parser) mustParse(s string) Token {
-	if p.tkns[0] != Token(s) {
-		panic("expected a " + s)
+// operand parses a number, x, function call, group or negated operand.
+func (p *Parser) operand() (Node, error) {
+	if len(p.tkns) == 0 {
+		return nil, fmt.Errorf("missing operand")
+	}
+	t := p.tkns[0]
+	p.tkns = p.tkns[1:]
+
+	switch {
+	case t.unary:
+		x, err := p.operand()
+		if err != nil {
+			return nil, err
+		}
+		return &Unary{Op: t.tok, X: x, Col: t.col}, nil
+	case t.tok == "(":
+		return p.group(t)
+	case t.tok == ")":
+		return nil, errorAt(t.col, "unexpected )")
+	case t.tok == "x":
+		if !p.bound {
+			return nil, errorAt(t.col, "x outside of a mapping")
+		}
+		return &Placeholder{Col: t.col}, nil
+	case name(t) && t.tok != "step":
+		return p.call(t)
+	case operand(t):
+		if err := checkValue(t); err != nil {
+			return nil, err
+		}
+		return &Value{Tok: t.tok}, nil
 	}
+	return nil, errorAt(t.col, "missing left operand for %s", t.tok)
+}
 
-	return p.parseAny()
+// group parses the rest of a group after its opening paren.
+func (p *Parser) group(open token) (Node, error) {
+	n := &Group{LParen: open.tok, Col: open.col}
+	if len(p.tkns) > 0 && p.tkns[0].tok == ")" {
+		n.Child = &List{}
+	} else {
+		child, err := p.expr(0)
+		if err != nil {
+			return nil, err
+		}
+		n.Child = child
+	}
+	if len(p.tkns) == 0 || p.tkns[0].tok != ")" {
+		return nil, errorAt(open.col, "unclosed (")
+	}
+	n.RParen = p.tkns[0].tok
+	p.tkns = p.tkns[1:]
+	return n, nil
 }
-func (p *Parser) parseAny() Token {
-	if len(p.tkns) == 0 {
-		panic("out of tokens")
+
+// call parses a function call after its name.
+func (p *Parser) call(t token) (Node, error) {
+	f, ok := p.reg.function(string(t.tok))
+	if len(p.tkns) == 0 || p.tkns[0].tok != "(" {
+		if !ok {
+			return nil, errorAt(t.col, "unexpected %q", t.tok)
+		}
+		return nil, errorAt(t.col, "%s needs (", t.tok)
 	}
-	out := p.tkns[0]
+	if !ok {
+		return nil, errorAt(t.col, "unknown function %s", t.tok)
+	}
+	open := p.tkns[0]
 	p.tkns = p.tkns[1:]
 
-	return out
-}
-func (p *Parser) parseGroup() Node {
-	n := Group{}
-	n.LParen = p.mustParse("(")
-	var children []Token
+	n := &Call{Name: string(t.tok), Col: t.col, fn: f}
+	if len(p.tkns) > 0 && p.tkns[0].tok == ")" {
+		p.tkns = p.tkns[1:]
+		return n, nil
+	}
 	for {
-		if p.tkns[0] == ")" {
-			n.RParen = p.mustParse(")")
-			break
+		arg, err := p.expr(0)
+		if err != nil {
+			return nil, err
+		}
+		n.Args = append(n.Args, arg)
+		if len(p.tkns) == 0 {
+			return nil, errorAt(open.col, "unclosed (")
 		}
-		children = append(children, p.parseAny())
+		next := p.tkns[0]
+		p.tkns = p.tkns[1:]
+		switch next.tok {
+		case ")":
+			return n, nil
+		case ",":
+			if len(p.tkns) == 0 || !operand(p.tkns[0]) {
+				return nil, errorAt(next.col, "missing argument after ,")
+			}
+		default:
+			return nil, errorAt(next.col, "unexpected %s", next.tok)
+		}
+	}
+}
+
+// combine builds the node for the operator t applied to l and r.
+func combine(t token, op operator, l, r Node) (Node, error) {
+	switch t.tok {
+	case "..", "…", "..<":
+		return &Range{From: l, To: r, Exclusive: t.tok == "..<", Col: t.col}, nil
+	case "step":
+		rng, ok := l.(*Range)
+		if !ok || rng.Step != nil {
+			return nil, errorAt(t.col, "step needs a range before it")
+		}
+		rng.Step = r
+		return rng, nil
+	}
+	return &Operator{Op: t.tok, LHS: l, RHS: r, Col: t.col, op: op}, nil
+}
+
+// checkValue reports whether Value.Evaluate can parse t.
+func checkValue(t token) error {
+	if _, err := t.tok.float(); err != nil {
+		return errorAt(t.col, "%v", err)
 	}
-	p2 := Parser{}
-	p2.tkns = children
-	n.Child = p2.Parse()
-	return &n
+	return nil
 }
@@ -1,6 +1,8 @@
 package eval_test
 
 import (
+	"fmt"
+	"math"
 	"testing"
 
 	"github.com/dianelooney/directive/eval"
@@ -17,9 +19,10 @@ func (c testCase) Test(t *testing.T) {
 
 	if len(actual) != len(expected) {
 		t.Errorf("Expected %v to match %v", actual, c.expected)
+		return
 	}
 	for i, v := range actual {
-		if v-expected[i] > 0.000001 {
+		if math.Abs(v-expected[i]) > 0.000001 {
 			t.Errorf("Expected %v to match %v", actual, c.expected)
 			return
 		}
@@ -48,9 +51,11 @@ func TestEval_Sub(t *testing.T) {
 		str:      `1 - 2`,
 		expected: []float64{-1},
 	}.Test(t)
+	// Like +, each right value is applied to every left value in turn:
+	// 1-3, 2-3, 1-4, 2-4.
 	testCase{
 		str:      `1 2 - 3 4`,
-		expected: []float64{-2, -3, -1, -2},
+		expected: []float64{-2, -1, -3, -2},
 	}.Test(t)
 }
 func TestEval_Mod(t *testing.T) {
@@ -78,6 +83,31 @@ func TestEval_Rep(t *testing.T) {
 	}.Test(t)
 }
 
+func TestEval_Zip(t *testing.T) {
+	testCase{
+		str:      `0 1 2 & 10 11 12`,
+		expected: []float64{0, 10, 1, 11, 2, 12},
+	}.Test(t)
+	testCase{
+		str:      `0 1 2 3 & 10`,
+		expected: []float64{0, 10, 1, 2, 3},
+	}.Test(t)
+	testCase{
+		str:      `0 & 10 11 12`,
+		expected: []float64{0, 10, 11, 12},
+	}.Test(t)
+}
+func TestEval_Concat(t *testing.T) {
+	testCase{
+		str:      `0 1 | 2 3`,
+		expected: []float64{0, 1, 2, 3},
+	}.Test(t)
+	testCase{
+		str:      `(0 % 1 0 4) | 8 9`,
+		expected: []float64{0, 1, 2, 3, 8, 9},
+	}.Test(t)
+}
+
 func TestEval_Thing(t *testing.T) {
 	testCase{
 		str:      `4 3 4 2 + 0 -1`,
@@ -88,3 +118,243 @@ func TestEval_Thing(t *testing.T) {
 func TestTokenize(t *testing.T) {
 	eval.Tokenize(`1(2 3 %4)`)
 }
+
+func TestEvalMax(t *testing.T) {
+	if _, err := eval.EvalMax(`0 * 100000000`, 1000); err == nil {
+		t.Errorf("Expected a length error")
+	}
+	out, err := eval.EvalMax(`0 1 * 2`, 4)
+	if err != nil || len(out) != 4 {
+		t.Errorf("Expected 4 values but got %v, %v", out, err)
+	}
+}
+
+func TestEvalE_Errors(t *testing.T) {
+	cases := map[string]string{
+		`1 + `:        "column 3: missing right operand for +",
+		`* 2`:         "column 1: missing left operand for *",
+		`(1 2`:        "column 1: unclosed (",
+		`1 2)`:        "column 4: unexpected )",
+		`1 abc 2`:     `column 3: unexpected "abc"`,
+		`1/0`:         "column 1: division by zero in 1/0",
+		`0 % 1 0`:     "column 3: % needs a modulus, min and max, got 2 values",
+		`0 % 0 0 4`:   "column 3: % needs a positive modulus, got 0",
+		`x + 1`:       "column 1: x outside of a mapping",
+		`0..4 step 0`: "column 2: range needs a non-zero step, got 0",
+		`(0 1)..4`:    "column 6: range start must be a single value, got 2",
+		`1 - - 1`:     "column 3: missing right operand for -",
+		`1 step 2`:    "column 3: step needs a range before it",
+		`(0 % 1 0 4)`: "",
+	}
+	for s, expected := range cases {
+		_, err := eval.EvalE(s)
+		if expected == "" && err != nil {
+			t.Errorf("%s: EvalE returned an error: %v", s, err)
+		}
+		if expected != "" && (err == nil || err.Error() != expected) {
+			t.Errorf("%s: expected error %q but got %v", s, expected, err)
+		}
+	}
+}
+func TestValue_Evaluate(t *testing.T) {
+	if out := (&eval.Value{Tok: "1/4"}).Evaluate(); len(out) != 1 || out[0] != 0.25 {
+		t.Errorf("Expected [0.25] but got %v", out)
+	}
+
+	defer func() {
+		if err, _ := recover().(error); err == nil || err.Error() != "invalid number abc" {
+			t.Errorf("Expected a panic with an invalid number error but got %v", err)
+		}
+	}()
+	(&eval.Value{Tok: "abc"}).Evaluate()
+}
+func TestEval_Exclude(t *testing.T) {
+	testCase{
+		str:      `0 % 1 0 16 \ 4 8 12`,
+		expected: []float64{0, 1, 2, 3, 5, 6, 7, 9, 10, 11, 13, 14, 15},
+	}.Test(t)
+	testCase{
+		str:      `0 1 2 1 \ 1 3`,
+		expected: []float64{0, 2},
+	}.Test(t)
+}
+func TestEval_Map(t *testing.T) {
+	testCase{
+		str:      `0 1 2 : x + 10`,
+		expected: []float64{10, 11, 12},
+	}.Test(t)
+	testCase{
+		str:      `1 2 : (x * 2) + 0.5`,
+		expected: []float64{1.5, 1.5, 2.5, 2.5},
+	}.Test(t)
+	testCase{
+		str:      `0 % 1 0 4 \ 2 : x x + 1`,
+		expected: []float64{1, 1, 2, 2, 4, 4},
+	}.Test(t)
+}
+func TestEval_Range(t *testing.T) {
+	testCase{
+		str:      `0..4`,
+		expected: []float64{0, 1, 2, 3, 4},
+	}.Test(t)
+	testCase{
+		str:      `0..<4`,
+		expected: []float64{0, 1, 2, 3},
+	}.Test(t)
+	testCase{
+		str:      `0…2 step 0.5`,
+		expected: []float64{0, 0.5, 1, 1.5, 2},
+	}.Test(t)
+	testCase{
+		str:      `4..0 step 2`,
+		expected: []float64{4, 2, 0},
+	}.Test(t)
+	testCase{
+		str:      `3..<0`,
+		expected: []float64{3, 2, 1},
+	}.Test(t)
+	testCase{
+		str:      `0..3 + 10 20`,
+		expected: []float64{10, 11, 12, 13, 20, 21, 22, 23},
+	}.Test(t)
+	testCase{
+		str:      `0..<16 \ 4 8 12 % 16 0 16`,
+		expected: []float64{0, 1, 2, 3, 5, 6, 7, 9, 10, 11, 13, 14, 15},
+	}.Test(t)
+}
+func TestEval_Precedence(t *testing.T) {
+	testCase{
+		str:      `5 - 1 - 1`,
+		expected: []float64{3},
+	}.Test(t)
+	testCase{
+		str:      `2 -1`,
+		expected: []float64{2, -1},
+	}.Test(t)
+	testCase{
+		str:      `(2-1) (3 - 1)`,
+		expected: []float64{1, 2},
+	}.Test(t)
+	testCase{
+		str:      `-(1 2) + -1`,
+		expected: []float64{-2, -3},
+	}.Test(t)
+	testCase{
+		str:      `0..3 8..<10 step 1`,
+		expected: []float64{0, 1, 2, 3, 8, 9},
+	}.Test(t)
+	testCase{
+		str:      `((1 2)) * 2`,
+		expected: []float64{1, 1, 2, 2},
+	}.Test(t)
+}
+func TestEval_Functions(t *testing.T) {
+	cases := map[string][]float64{
+		`euclid(3, 8)`:               {0, 3, 6},
+		`euclid(5, 16)`:              {0, 3, 6, 9, 12},
+		`euclid(4, 4)`:               {0, 1, 2, 3},
+		`euclid(0, 8)`:               {},
+		`rev(0..3)`:                  {3, 2, 1, 0},
+		`rot(0..3, 1)`:               {1, 2, 3, 0},
+		`rot(0..3, -1)`:              {3, 0, 1, 2},
+		`sort(shuffle(0..9, 7))`:     {0, 1, 2, 3, 4, 5, 6, 7, 8, 9},
+		`stretch(0 1 2, 4)`:          {0, 4, 8},
+		`palindrome(0 1 2)`:          {0, 1, 2, 1, 0},
+		`take(0..9, 3)`:              {0, 1, 2},
+		`drop(0..9, 8)`:              {8, 9},
+		`take(0 1, 5)`:               {0, 1},
+		`sort(3 1 2)`:                {1, 2, 3},
+		`euclid(3, 8) + 0 8`:         {0, 3, 6, 8, 11, 14},
+		`rev(euclid(3, 8)) : x * 2`:  {6, 6, 3, 3, 0, 0},
+		`0 take(rot(1 2 3, 2), 1) 9`: {0, 3, 9},
+		`choose(5, 3, 1)`:            {5, 5, 5},
+	}
+	for s, expected := range cases {
+		out, err := eval.EvalE(s)
+		if err != nil {
+			t.Errorf("%s: %v", s, err)
+			continue
+		}
+		if fmt.Sprint(out) != fmt.Sprint(expected) {
+			t.Errorf("%s: expected %v but got %v", s, expected, out)
+		}
+	}
+
+	if fmt.Sprint(eval.Eval(`shuffle(0..9, 7)`)) != fmt.Sprint(eval.Eval(`shuffle(0..9, 7)`)) {
+		t.Errorf("Expected shuffle to depend only on its seed")
+	}
+	if out := eval.Eval(`choose(1 2 3, 8, 42)`); len(out) != 8 || fmt.Sprint(out) != fmt.Sprint(eval.Eval(`choose(1 2 3, 8, 42)`)) {
+		t.Errorf("Expected choose to pick 8 values depending only on its seed, got %v", out)
+	}
+}
+
+func TestEval_FunctionErrors(t *testing.T) {
+	cases := map[string]string{
+		`euclid(5)`:        "column 1: euclid needs 2 arguments, got 1",
+		`euclid(9, 8)`:     "column 1: euclid needs 0 <= k <= n <= 65536, got 9, 8",
+		`1 rot(0 1, 0.5)`:  "column 3: rot needs a whole number for argument 2, got [0.5]",
+		`take(0 1, -1)`:    "column 1: take needs a count of at least 0 for argument 2, got -1",
+		`choose(, 1, 2)`:   "column 8: missing left operand for ,",
+		`choose((), 1, 2)`: "column 1: choose needs a sequence to choose from",
+		`stretch(1, 2 3)`:  "column 1: stretch needs a single factor, got 2 values",
+	}
+	for s, expected := range cases {
+		_, err := eval.EvalE(s)
+		if err == nil || err.Error() != expected {
+			t.Errorf("%s: expected error %q but got %v", s, expected, err)
+		}
+	}
+	if _, err := eval.EvalMax(`palindrome(0..9)`, 10); err == nil {
+		t.Errorf("Expected a length error")
+	}
+}
+
+func TestEval_Random(t *testing.T) {
+	for _, s := range []string{`rand(2, 4)`, `randi(1, 6)`, `0..15 : x * chance(0.5)`, `jitter(0..7, 0.1)`} {
+		out := eval.Eval(s, eval.WithSeed(7))
+		if again := eval.Eval(s, eval.WithSeed(7)); fmt.Sprint(out) != fmt.Sprint(again) {
+			t.Errorf("%s: expected the same values for the same seed, got %v and %v", s, out, again)
+		}
+	}
+
+	distinct := map[string]bool{}
+	for seed := uint64(0); seed < 20; seed++ {
+		v := eval.Eval(`randi(1, 6)`, eval.WithSeed(seed))[0]
+		if v < 1 || v > 6 {
+			t.Errorf("randi(1, 6) returned %v", v)
+		}
+		distinct[fmt.Sprint(v)] = true
+	}
+	if len(distinct) < 2 {
+		t.Errorf("Expected randi to depend on the seed")
+	}
+
+	out := eval.Eval(`0..7 : rand(0, 1)`)
+	if fmt.Sprint(out[:4]) == fmt.Sprint(out[4:]) {
+		t.Errorf("Expected every call to draw new numbers, got %v", out)
+	}
+	for i, v := range eval.Eval(`jitter(0..7, 0.1)`) {
+		if math.Abs(v-float64(i)) > 0.1 {
+			t.Errorf("jitter moved %d to %v", i, v)
+		}
+	}
+	if out := eval.Eval(`0..7 : x * chance(1)`); len(out) != 8 {
+		t.Errorf("Expected chance(1) to keep every step, got %v", out)
+	}
+	if out := eval.Eval(`0..7 : x * chance(0)`); len(out) != 0 {
+		t.Errorf("Expected chance(0) to drop every step, got %v", out)
+	}
+
+	cases := map[string]string{
+		`rand(4, 2)`:      "column 1: rand needs min <= max, got 4, 2",
+		`chance(2)`:       "column 1: chance needs a probability between 0 and 1, got 2",
+		`randi(0.5, 2)`:   "column 1: randi needs a whole number for argument 1, got [0.5]",
+		`jitter(0 1, -1)`: "column 1: jitter needs an amount of at least 0, got -1",
+	}
+	for s, expected := range cases {
+		_, err := eval.EvalE(s)
+		if err == nil || err.Error() != expected {
+			t.Errorf("%s: expected error %q but got %v", s, expected, err)
+		}
+	}
+}
@@ -0,0 +1,284 @@
+package eval
+
+import (
+	"fmt"
+	"math"
+	"math/big"
+	"math/rand/v2"
+	"sort"
+)
+
+// builtinFunctions are the functions of every registry:
+//
+//	euclid(k, n)          the positions of k onsets spread as evenly as
+//	                      possible over n steps, the Euclidean rhythm E(k, n)
+//	rev(seq)              seq backwards
+//	rot(seq, n)           seq rotated left by n; a negative n rotates right
+//	shuffle(seq, seed)    seq in an order that depends only on seed
+//	choose(seq, n, seed)  n elements of seq picked at random, with repeats,
+//	                      depending only on seed
+//	stretch(seq, f)       every element of seq multiplied by f
+//	palindrome(seq)       seq followed by itself backwards, without
+//	                      repeating its last element
+//	take(seq, n)          the first n elements of seq
+//	drop(seq, n)          seq without its first n elements
+//	sort(seq)             seq in ascending order
+//	rand(min, max)        a random number in [min, max)
+//	randi(min, max)       a random whole number in [min, max]
+//	chance(p)             1 with probability p, otherwise 0
+//	jitter(seq, amount)   every element of seq moved by a random amount in
+//	                      [-amount, amount]
+//
+// The last four draw from the evaluation's random source, see WithSeed.
+// chance makes probabilistic patterns with *: "0..15 : x * chance(0.5)"
+// keeps each step with even odds.
+var builtinFunctions = map[string]function{
+	"euclid":     builtin("euclid", 2, euclid),
+	"rev":        picks(builtin("rev", 1, rev)),
+	"rot":        picks(builtin("rot", 2, rot)),
+	"shuffle":    picks(builtin("shuffle", 2, shuffle)),
+	"choose":     picks(builtin("choose", 3, choose)),
+	"stretch":    exact("stretch", 2, stretch, stretchRat),
+	"palindrome": picks(builtin("palindrome", 1, palindrome)),
+	"take":       picks(builtin("take", 2, take)),
+	"drop":       picks(builtin("drop", 2, drop)),
+	"sort":       exact("sort", 1, sortSeq, sortRat),
+	"rand":       builtin("rand", 2, random),
+	"randi":      builtin("randi", 2, randi),
+	"chance":     builtin("chance", 1, chance),
+	"jitter":     builtin("jitter", 2, jitter),
+}
+
+// maxSteps is the most steps euclid spreads its onsets over.
+const maxSteps = 1 << 16
+
+// builtin makes the function name of f, which takes exactly arity
+// arguments.
+func builtin(name string, arity int, f func(s scope, args [][]float64) ([]float64, error)) function {
+	return function{fn: func(s scope, args [][]float64) ([]float64, error) {
+		if err := checkArity(name, arity, len(args)); err != nil {
+			return nil, err
+		}
+		return f(s, args)
+	}}
+}
+
+// exact is like builtin, but also computes the function exactly with rat.
+func exact(name string, arity int, f func(s scope, args [][]float64) ([]float64, error), rat func(s scope, args [][]*big.Rat) ([]*big.Rat, error)) function {
+	fn := builtin(name, arity, f)
+	fn.rat = func(s scope, args [][]*big.Rat) ([]*big.Rat, error) {
+		if err := checkArity(name, arity, len(args)); err != nil {
+			return nil, err
+		}
+		return rat(s, args)
+	}
+	return fn
+}
+
+func checkArity(name string, arity, n int) error {
+	if n != arity {
+		return fmt.Errorf("%s needs %d arguments, got %d", name, arity, n)
+	}
+	return nil
+}
+
+// picks marks f as only picking elements of its first argument.
+func picks(f function) function {
+	f.picks = true
+	return f
+}
+
+// whole returns the i-th argument of name, which must be a single whole
+// number.
+func whole(name string, args [][]float64, i int) (int, error) {
+	arg := args[i]
+	if len(arg) != 1 || arg[0] != math.Trunc(arg[0]) || math.Abs(arg[0]) > math.MaxInt32 {
+		return 0, fmt.Errorf("%s needs a whole number for argument %d, got %v", name, i+1, arg)
+	}
+	return int(arg[0]), nil
+}
+
+// count is like whole, but the number may not be negative.
+func count(name string, args [][]float64, i int) (int, error) {
+	n, err := whole(name, args, i)
+	if err == nil && n < 0 {
+		err = fmt.Errorf("%s needs a count of at least 0 for argument %d, got %d", name, i+1, n)
+	}
+	return n, err
+}
+
+// euclid computes E(k, n) with Bjorklund's algorithm: onsets and rests
+// start as separate groups, and rests are dealt onto the onset groups
+// until at most one group is left over.
+func euclid(s scope, args [][]float64) ([]float64, error) {
+	k, err := count("euclid", args, 0)
+	if err != nil {
+		return nil, err
+	}
+	n, err := count("euclid", args, 1)
+	if err != nil {
+		return nil, err
+	}
+	if k > n || n > maxSteps {
+		return nil, fmt.Errorf("euclid needs 0 <= k <= n <= %d, got %d, %d", maxSteps, k, n)
+	}
+	if k == 0 {
+		return []float64{}, nil
+	}
+	if err := checkLength(k, s.limit); err != nil {
+		return nil, err
+	}
+
+	a := make([][]bool, k)
+	for i := range a {
+		a[i] = []bool{true}
+	}
+	b := make([][]bool, n-k)
+	for i := range b {
+		b[i] = []bool{false}
+	}
+	for len(b) > 1 {
+		m := len(a)
+		if len(b) < m {
+			m = len(b)
+		}
+		next := make([][]bool, m)
+		for i := range next {
+			next[i] = append(a[i], b[i]...)
+		}
+		if len(a) > m {
+			a, b = next, a[m:]
+		} else {
+			a, b = next, b[m:]
+		}
+	}
+
+	out := make([]float64, 0, k)
+	step := 0
+	for _, group := range append(a, b...) {
+		for _, onset := range group {
+			if onset {
+				out = append(out, float64(step))
+			}
+			step++
+		}
+	}
+	return out, nil
+}
+
+func rev(s scope, args [][]float64) ([]float64, error) {
+	seq := args[0]
+	out := make([]float64, len(seq))
+	for i, v := range seq {
+		out[len(seq)-1-i] = v
+	}
+	return out, nil
+}
+
+func rot(s scope, args [][]float64) ([]float64, error) {
+	seq := args[0]
+	n, err := whole("rot", args, 1)
+	if err != nil || len(seq) == 0 {
+		return seq, err
+	}
+	n %= len(seq)
+	if n < 0 {
+		n += len(seq)
+	}
+	out := make([]float64, 0, len(seq))
+	return append(append(out, seq[n:]...), seq[:n]...), nil
+}
+
+// seeded returns a generator for the seed argument i of name.
+func seeded(name string, args [][]float64, i int) (*rand.Rand, error) {
+	seed, err := whole(name, args, i)
+	if err != nil {
+		return nil, err
+	}
+	return rand.New(rand.NewPCG(uint64(seed), 0)), nil
+}
+
+func shuffle(s scope, args [][]float64) ([]float64, error) {
+	r, err := seeded("shuffle", args, 1)
+	if err != nil {
+		return nil, err
+	}
+	out := append([]float64(nil), args[0]...)
+	for i := len(out) - 1; i > 0; i-- {
+		j := r.IntN(i + 1)
+		out[i], out[j] = out[j], out[i]
+	}
+	return out, nil
+}
+
+func choose(s scope, args [][]float64) ([]float64, error) {
+	seq := args[0]
+	n, err := count("choose", args, 1)
+	if err != nil {
+		return nil, err
+	}
+	r, err := seeded("choose", args, 2)
+	if err != nil {
+		return nil, err
+	}
+	if n > 0 && len(seq) == 0 {
+		return nil, fmt.Errorf("choose needs a sequence to choose from")
+	}
+	if err := checkLength(n, s.limit); err != nil {
+		return nil, err
+	}
+	out := make([]float64, n)
+	for i := range out {
+		out[i] = seq[r.IntN(len(seq))]
+	}
+	return out, nil
+}
+
+func stretch(s scope, args [][]float64) ([]float64, error) {
+	if len(args[1]) != 1 {
+		return nil, fmt.Errorf("stretch needs a single factor, got %d values", len(args[1]))
+	}
+	f := args[1][0]
+	out := make([]float64, len(args[0]))
+	for i, v := range args[0] {
+		out[i] = v * f
+	}
+	return out, nil
+}
+
+func palindrome(s scope, args [][]float64) ([]float64, error) {
+	seq := args[0]
+	if len(seq) == 0 {
+		return seq, nil
+	}
+	if err := checkLength(2*len(seq)-1, s.limit); err != nil {
+		return nil, err
+	}
+	out := append([]float64(nil), seq...)
+	for i := len(seq) - 2; i >= 0; i-- {
+		out = append(out, seq[i])
+	}
+	return out, nil
+}
+
+func take(s scope, args [][]float64) ([]float64, error) {
+	n, err := count("take", args, 1)
+	if err != nil {
+		return nil, err
+	}
+	return args[0][:min(n, len(args[0]))], nil
+}
+
+func drop(s scope, args [][]float64) ([]float64, error) {
+	n, err := count("drop", args, 1)
+	if err != nil {
+		return nil, err
+	}
+	return args[0][min(n, len(args[0])):], nil
+}
+
+func sortSeq(s scope, args [][]float64) ([]float64, error) {
+	out := append([]float64(nil), args[0]...)
+	sort.Float64s(out)
+	return out, nil
+}
@@ -2,87 +2,145 @@ package eval
 
 import (
 	"fmt"
-	"strconv"
+	"math"
+	"math/big"
+	"math/rand/v2"
 	"strings"
 )
 
+// Node is a node of a parsed expression. Evaluate computes all of its
+// values at once. Nodes that also implement Streamer are computed one value
+// at a time wherever the expression is streamed, as every node of this
+// package is; other nodes are evaluated in full when they are reached.
 type Node interface {
 	Evaluate() []float64
 }
 
+// Streamer is a Node that can compute its values one at a time.
+type Streamer interface {
+	Node
+	// Stream calls yield with the values of the node in order until yield
+	// returns false, and reports whether yield wanted more values. Like
+	// Evaluate, it panics if the node cannot be evaluated.
+	Stream(yield func(float64) bool) bool
+}
+
+// streamNode streams n outside of any mapping, panicking on errors.
+func streamNode(n Node, yield func(float64) bool) bool {
+	more, err := stream(n, newScope(0, 0), yield)
+	if err != nil {
+		panic(err)
+	}
+	return more
+}
+
 type Group struct {
 	LParen Node
 	Child  Node
 	RParen Node
+	// Col is the one-based column of LParen in the source, for errors.
+	Col int
 }
 
 func (n *Group) Evaluate() (out []float64) {
 	return n.Child.Evaluate()
 }
 
+// Stream streams the values of n. It panics if n cannot be evaluated.
+func (n *Group) Stream(yield func(float64) bool) bool {
+	return streamNode(n, yield)
+}
+
 func (n *Group) String() string {
 	return fmt.Sprintf("(%s)", n.Child)
 }
 
+// Operator combines the values of two sequences:
+//
+//	a + b  adds every element of b to every element of a
+//	a - b  subtracts every element of b from every element of a
+//	a % b  wraps a by the modulus b[0] into [b[1], b[2]) and repeats it
+//	a * b  repeats each element of a by every count in b
+//	a & b  interleaves a and b: a[0] b[0] a[1] b[1] ...; when one is
+//	       longer, the rest of it follows the interleaved part
+//	a | b  concatenates a and b
+//	a \ b  removes the elements of b from a
+//	a : b  evaluates b once for every element of a, with x standing for
+//	       the element, and concatenates the results
+//
+// Other operators can be added with RegisterOperator.
 type Operator struct {
 	Op  Token
 	LHS Node
 	RHS Node
+	// Col is the one-based column of Op in the source, for errors.
+	Col int
+
+	// op computes the operator. It is looked up in the registry when the
+	// expression is compiled, and in the default registry when not.
+	op operator
 }
 
+// epsilon is how close two values must be to count as equal for \.
+const epsilon = 1e-9
+
+// Evaluate evaluates n. It panics if n cannot be evaluated; use Compile
+// and Expr.Eval to get an error instead.
 func (n *Operator) Evaluate() (out []float64) {
-	left := n.LHS.Evaluate()
-	right := n.RHS.Evaluate()
-
-	switch n.Op {
-	case "+":
-		i := 0
-		out = make([]float64, len(left)*len(right))
-		for _, y := range right {
-			for _, x := range left {
-				out[i] = x + y
-				i++
-			}
-		}
-		return
-	case "-":
-		i := 0
-		out = make([]float64, len(left)*len(right))
-		for _, y := range right {
-			for _, x := range left {
-				out[i] = x - y
-				i++
-			}
-		}
-		return
-	case "%":
-		mod := right[0]
-		min := right[1]
-		max := right[2]
-		for _, v := range left {
-			for v >= min {
-				v -= mod
-			}
-			for v < min {
-				v += mod
-			}
-			for ; v < max; v += mod {
-				out = append(out, v)
-			}
-		}
-		return out
-	case "*":
-		for _, count := range right {
-			for _, x := range left {
-				for i := 0; i < int(count); i++ {
-					out = append(out, x)
-				}
-			}
-		}
-		return out
+	out, err := collect(n, newScope(0, 0))
+	if err != nil {
+		panic(err)
 	}
+	return out
+}
 
-	panic("operator " + string(n.Op) + " not supported in *Operator.Evaluate()")
+// Stream streams the values of n. It panics if n cannot be evaluated.
+func (n *Operator) Stream(yield func(float64) bool) bool {
+	return streamNode(n, yield)
+}
+
+func (n *Operator) stream(s scope, yield func(float64) bool) (bool, error) {
+	if n.Op == ":" {
+		return forEach(n.LHS, s, func(x float64) (bool, error) {
+			inner := s
+			inner.x, inner.bound = x, true
+			return stream(n.RHS, inner, yield)
+		})
+	}
+
+	op, err := n.resolve()
+	if err != nil {
+		return false, err
+	}
+	if op.stream != nil {
+		more, err := op.stream(s, n.LHS, n.RHS, yield)
+		return more, wrap(n.Col, err)
+	}
+	left, err := collect(n.LHS, s)
+	if err != nil {
+		return false, err
+	}
+	right, err := collect(n.RHS, s)
+	if err != nil {
+		return false, err
+	}
+	out, err := op.fn(left, right, s.limit)
+	if err != nil {
+		return false, wrap(n.Col, err)
+	}
+	return yieldAll(out, yield), nil
+}
+
+// resolve returns the operator of n.
+func (n *Operator) resolve() (operator, error) {
+	if n.op.fn != nil || n.op.stream != nil {
+		return n.op, nil
+	}
+	op, ok := defaultRegistry.operator(string(n.Op))
+	if !ok || op.fn == nil && op.stream == nil {
+		return op, errorAt(n.Col, "operator %s is not supported", n.Op)
+	}
+	return op, nil
 }
 
 func (n *Operator) String() string {
@@ -93,27 +151,293 @@ type Value struct {
 	Tok Token
 }
 
+// Evaluate evaluates n. It panics if n cannot be evaluated; use Compile
+// and Expr.Eval to get an error instead.
 func (n *Value) Evaluate() (out []float64) {
-	if idx := strings.Index(string(n.Tok), "/"); idx >= 0 {
-		lhs, _ := strconv.ParseFloat(string(n.Tok)[:idx], 64)
-		rhs, _ := strconv.ParseFloat(string(n.Tok)[idx+1:], 64)
-		return []float64{lhs / rhs}
-	}
-	f, _ := strconv.ParseFloat(string(n.Tok), 64)
-	return []float64{f}
+	return n.Tok.Evaluate()
+}
+
+// Stream streams the values of n. It panics if n cannot be evaluated.
+func (n *Value) Stream(yield func(float64) bool) bool {
+	return streamNode(n, yield)
 }
 
 func (n *Value) String() string {
 	return string(n.Tok)
 }
 
+// Unary is a prefix operator. The only one is -, which negates every
+// element of X.
+type Unary struct {
+	Op Token
+	X  Node
+	// Col is the one-based column of Op in the source, for errors.
+	Col int
+}
+
+// Evaluate evaluates n. It panics if n cannot be evaluated; use Compile
+// and Expr.Eval to get an error instead.
+func (n *Unary) Evaluate() []float64 {
+	out, err := collect(n, newScope(0, 0))
+	if err != nil {
+		panic(err)
+	}
+	return out
+}
+
+// Stream streams the values of n. It panics if n cannot be evaluated.
+func (n *Unary) Stream(yield func(float64) bool) bool {
+	return streamNode(n, yield)
+}
+
+func (n *Unary) stream(s scope, yield func(float64) bool) (bool, error) {
+	if n.Op != "-" {
+		return false, errorAt(n.Col, "operator %s is not supported", n.Op)
+	}
+	return stream(n.X, s, func(x float64) bool {
+		return yield(-x)
+	})
+}
+
+func (n *Unary) String() string {
+	return fmt.Sprintf("%s%s", n.Op, n.X)
+}
+
+// Range counts from From to To by Step, or by 1 without a Step:
+//
+//	a..b          a, a+1, ... up to and including b
+//	a…b           the same as a..b
+//	a..<b         a, a+1, ... up to but not including b
+//	a..b step s   a, a+s, a+2s, ... up to and including b
+//
+// A range counts down when To is less than From; the sign of Step is
+// ignored. From, To and Step must each be a single value.
+type Range struct {
+	From      Node
+	To        Node
+	Step      Node
+	Exclusive bool
+	// Col is the one-based column of the range operator, for errors.
+	Col int
+}
+
+// Evaluate evaluates n. It panics if n cannot be evaluated; use Compile
+// and Expr.Eval to get an error instead.
+func (n *Range) Evaluate() []float64 {
+	out, err := collect(n, newScope(0, 0))
+	if err != nil {
+		panic(err)
+	}
+	return out
+}
+
+// Stream streams the values of n. It panics if n cannot be evaluated.
+func (n *Range) Stream(yield func(float64) bool) bool {
+	return streamNode(n, yield)
+}
+
+func (n *Range) stream(s scope, yield func(float64) bool) (bool, error) {
+	from, err := n.single(n.From, "start", s)
+	if err != nil {
+		return false, err
+	}
+	to, err := n.single(n.To, "end", s)
+	if err != nil {
+		return false, err
+	}
+	step := 1.0
+	if n.Step != nil {
+		if step, err = n.single(n.Step, "step", s); err != nil {
+			return false, err
+		}
+		step = math.Abs(step)
+		if step == 0 || math.IsNaN(step) || math.IsInf(step, 0) {
+			return false, errorAt(n.Col, "range needs a non-zero step, got %v", step)
+		}
+	}
+	if to < from {
+		step = -step
+	}
+
+	count := math.Floor((to-from)/step+epsilon) + 1
+	if n.Exclusive && math.Abs(from+(count-1)*step-to) < epsilon {
+		count--
+	}
+	if math.IsNaN(count) || count > math.MaxInt32 {
+		return false, errorAt(n.Col, "range from %v to %v is too long", from, to)
+	}
+	for i := 0; i < int(count); i++ {
+		if !yield(from + float64(i)*step) {
+			return false, nil
+		}
+	}
+	return true, nil
+}
+
+// single evaluates the bound or step n, which must be a single value.
+func (n *Range) single(b Node, what string, s scope) (float64, error) {
+	v, err := collect(b, s)
+	if err != nil {
+		return 0, err
+	}
+	if len(v) != 1 {
+		return 0, errorAt(n.Col, "range %s must be a single value, got %d", what, len(v))
+	}
+	return v[0], nil
+}
+
+func (n *Range) String() string {
+	op := ".."
+	if n.Exclusive {
+		op = "..<"
+	}
+	if n.Step != nil {
+		return fmt.Sprintf("%s%s%s step %s", n.From, op, n.To, n.Step)
+	}
+	return fmt.Sprintf("%s%s%s", n.From, op, n.To)
+}
+
+// Call is a call of a registered function, name(arg, ...). Each argument
+// is evaluated to a sequence before the function is called.
+type Call struct {
+	Name string
+	Args []Node
+	// Col is the one-based column of Name in the source, for errors.
+	Col int
+
+	fn function
+}
+
+// Evaluate evaluates n. It panics if n cannot be evaluated; use Compile
+// and Expr.Eval to get an error instead.
+func (n *Call) Evaluate() []float64 {
+	out, err := collect(n, newScope(0, 0))
+	if err != nil {
+		panic(err)
+	}
+	return out
+}
+
+// Stream streams the values of n. It panics if n cannot be evaluated.
+func (n *Call) Stream(yield func(float64) bool) bool {
+	return streamNode(n, yield)
+}
+
+func (n *Call) stream(s scope, yield func(float64) bool) (bool, error) {
+	f, err := n.resolve()
+	if err != nil {
+		return false, err
+	}
+	args := make([][]float64, len(n.Args))
+	for i, arg := range n.Args {
+		if args[i], err = collect(arg, s); err != nil {
+			return false, err
+		}
+	}
+	out, err := f.fn(s, args)
+	if err != nil {
+		return false, wrap(n.Col, err)
+	}
+	return yieldAll(out, yield), nil
+}
+
+// resolve returns the function of n.
+func (n *Call) resolve() (function, error) {
+	if n.fn.fn != nil {
+		return n.fn, nil
+	}
+	f, ok := defaultRegistry.function(n.Name)
+	if !ok {
+		return f, errorAt(n.Col, "unknown function %s", n.Name)
+	}
+	return f, nil
+}
+
+func (n *Call) String() string {
+	args := make([]string, len(n.Args))
+	for i, arg := range n.Args {
+		args[i] = fmt.Sprint(arg)
+	}
+	return fmt.Sprintf("%s(%s)", n.Name, strings.Join(args, ", "))
+}
+
+// Placeholder is the x of a mapping. It stands for each element of the
+// mapped sequence in turn.
+type Placeholder struct {
+	// Col is the one-based column of the x in the source, for errors.
+	Col int
+}
+
+// Evaluate panics: x only has a value inside a mapping.
+func (n *Placeholder) Evaluate() []float64 {
+	panic(errorAt(n.Col, "x outside of a mapping"))
+}
+
+// Stream panics: x only has a value inside a mapping.
+func (n *Placeholder) Stream(yield func(float64) bool) bool {
+	return streamNode(n, yield)
+}
+
+func (n *Placeholder) String() string {
+	return "x"
+}
+
 type List struct {
 	Nums []Node
 }
 
 func (n *List) Evaluate() (out []float64) {
+	out, err := collect(n, newScope(0, 0))
+	if err != nil {
+		panic(err)
+	}
+	return out
+}
+
+// Stream streams the values of n. It panics if n cannot be evaluated.
+func (n *List) Stream(yield func(float64) bool) bool {
+	return streamNode(n, yield)
+}
+
+func (n *List) stream(s scope, yield func(float64) bool) (bool, error) {
 	for _, num := range n.Nums {
-		out = append(out, num.Evaluate()...)
+		if more, err := stream(num, s, yield); !more || err != nil {
+			return false, err
+		}
+	}
+	return true, nil
+}
+
+// LengthError is returned by EvalMax when an expression expands to more
+// values than allowed.
+type LengthError struct {
+	Max int
+}
+
+func (e *LengthError) Error() string {
+	return fmt.Sprintf("expression expands to more than %d values", e.Max)
+}
+
+func checkLength(n, limit int) error {
+	if limit > 0 && n > limit {
+		return &LengthError{Max: limit}
 	}
-	return
+	return nil
+}
+
+// scope is the state of an evaluation: the length limit, where 0 is
+// unlimited, the element x is bound to inside a mapping, as rx in exact
+// evaluation, and the random source of the random functions.
+type scope struct {
+	limit int
+	x     float64
+	rx    *big.Rat
+	bound bool
+	rng   *rand.Rand
+}
+
+// newScope returns the scope of an evaluation with the given limit whose
+// random functions are seeded by seed.
+func newScope(limit int, seed uint64) scope {
+	return scope{limit: limit, rng: rand.New(rand.NewPCG(seed, 0))}
 }
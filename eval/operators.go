@@ -0,0 +1,182 @@
+package eval
+
+import (
+	"fmt"
+	"math"
+)
+
+// The built-in operators stream their values. To keep the random
+// functions drawing in the same order in every mode, an operand is only
+// streamed when everything evaluated before it is known.
+
+func add(s scope, l, r Node, yield func(float64) bool) (bool, error) {
+	return broadcastStream(s, l, r, yield, func(x, y float64) float64 { return x + y })
+}
+
+func sub(s scope, l, r Node, yield func(float64) bool) (bool, error) {
+	return broadcastStream(s, l, r, yield, func(x, y float64) float64 { return x - y })
+}
+
+// broadcastStream applies f to every element of l with every element of
+// r, l varying fastest.
+func broadcastStream(s scope, l, r Node, yield func(float64) bool, f func(x, y float64) float64) (bool, error) {
+	left, err := collect(l, s)
+	if err != nil {
+		return false, err
+	}
+	return forEach(r, s, func(y float64) (bool, error) {
+		for _, x := range left {
+			if !yield(f(x, y)) {
+				return false, nil
+			}
+		}
+		return true, nil
+	})
+}
+
+// broadcast is the slice form of broadcastStream.
+func broadcast[T any](left, right []T, limit int, f func(x, y T) T) ([]T, error) {
+	if err := checkLength(len(left)*len(right), limit); err != nil {
+		return nil, err
+	}
+	i := 0
+	out := make([]T, len(left)*len(right))
+	for _, y := range right {
+		for _, x := range left {
+			out[i] = f(x, y)
+			i++
+		}
+	}
+	return out, nil
+}
+
+func mod(s scope, l, r Node, yield func(float64) bool) (bool, error) {
+	left, err := collect(l, s)
+	if err != nil {
+		return false, err
+	}
+	right, err := collect(r, s)
+	if err != nil {
+		return false, err
+	}
+	if len(right) != 3 {
+		return false, fmt.Errorf("%% needs a modulus, min and max, got %d values", len(right))
+	}
+	mod := right[0]
+	min := right[1]
+	max := right[2]
+	if !(mod > 0) {
+		return false, fmt.Errorf("%% needs a positive modulus, got %v", mod)
+	}
+	for _, v := range left {
+		v = math.Mod(v-min, mod)
+		if v < 0 {
+			v += mod
+		}
+		for v += min; v < max; v += mod {
+			if !yield(v) {
+				return false, nil
+			}
+		}
+	}
+	return true, nil
+}
+
+func rep(s scope, l, r Node, yield func(float64) bool) (bool, error) {
+	left, err := collect(l, s)
+	if err != nil {
+		return false, err
+	}
+	return forEach(r, s, func(count float64) (bool, error) {
+		if count < 0 {
+			return false, fmt.Errorf("* needs counts of at least 0, got %v", count)
+		}
+		c := int(math.Min(count, math.MaxInt32))
+		for _, x := range left {
+			for i := 0; i < c; i++ {
+				if !yield(x) {
+					return false, nil
+				}
+			}
+		}
+		return true, nil
+	})
+}
+
+func interleaveStream(s scope, l, r Node, yield func(float64) bool) (bool, error) {
+	left, err := collect(l, s)
+	if err != nil {
+		return false, err
+	}
+	i := 0
+	more, err := forEach(r, s, func(y float64) (bool, error) {
+		if i < len(left) && !yield(left[i]) {
+			return false, nil
+		}
+		i++
+		return yield(y), nil
+	})
+	if !more || err != nil {
+		return false, err
+	}
+	if i < len(left) {
+		return yieldAll(left[i:], yield), nil
+	}
+	return true, nil
+}
+
+func concatStream(s scope, l, r Node, yield func(float64) bool) (bool, error) {
+	if more, err := stream(l, s, yield); !more || err != nil {
+		return false, err
+	}
+	return stream(r, s, yield)
+}
+
+func exclude(s scope, l, r Node, yield func(float64) bool) (bool, error) {
+	left, err := collect(l, s)
+	if err != nil {
+		return false, err
+	}
+	right, err := collect(r, s)
+	if err != nil {
+		return false, err
+	}
+	for _, v := range left {
+		if !contains(right, v) && !yield(v) {
+			return false, nil
+		}
+	}
+	return true, nil
+}
+
+func interleave[T any](left, right []T, limit int) ([]T, error) {
+	if err := checkLength(len(left)+len(right), limit); err != nil {
+		return nil, err
+	}
+	out := make([]T, 0, len(left)+len(right))
+	for i := 0; i < len(left) || i < len(right); i++ {
+		if i < len(left) {
+			out = append(out, left[i])
+		}
+		if i < len(right) {
+			out = append(out, right[i])
+		}
+	}
+	return out, nil
+}
+
+func concat[T any](left, right []T, limit int) ([]T, error) {
+	if err := checkLength(len(left)+len(right), limit); err != nil {
+		return nil, err
+	}
+	return append(left[:len(left):len(left)], right...), nil
+}
+
+func contains(vs []float64, v float64) bool {
+	for _, w := range vs {
+		if math.Abs(v-w) < epsilon {
+			return true
+		}
+	}
+	return false
+}
@@ -1,7 +1,31 @@
 package eval
 
-var order = []map[string]bool{
-	{"%": true},
-	{"+": true, "-": true},
-	{"*": true, "&": true, "|": true},
+import "math/big"
+
+// builtinOperators are the operators of every registry. Operators with a
+// higher power are applied first, and operators of the same power
+// associate to the left, so "5 - 1 - 1" is "(5 - 1) - 1". Powers are
+// spaced out so that registered operators can bind between them.
+//
+// The mapping, range and step operators have no function: the parser
+// builds their own nodes.
+var builtinOperators = map[string]operator{
+	":":    {power: 10},
+	"\\":   {power: 20, stream: exclude, rat: excludeRat},
+	"%":    {power: 30, stream: mod, rat: modRat},
+	"+":    {power: 40, stream: add, rat: addRat},
+	"-":    {power: 40, stream: sub, rat: subRat},
+	"*":    {power: 50, stream: rep, rat: repRat, ratStream: repRatStream},
+	"&":    {power: 50, stream: interleaveStream, rat: interleave[*big.Rat]},
+	"|":    {power: 50, stream: concatStream, rat: concat[*big.Rat], ratStream: concatRatStream},
+	"step": {power: 70},
+	"..":   {power: 80},
+	"..<":  {power: 80},
+	"…":    {power: 80},
 }
+
+// listPower is how tightly operands written next to each other bind into
+// a List: tighter than the arithmetic operators, so "1 2 + 3 4" adds two
+// lists, but looser than ranges, so "0..3 8..11" lists two ranges. Unary
+// minus binds tightest of all.
+const listPower = 60
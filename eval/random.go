@@ -0,0 +1,80 @@
+package eval
+
+import (
+	"fmt"
+	"math"
+)
+
+// single returns the i-th argument of name, which must be a single value.
+func single(name string, args [][]float64, i int) (float64, error) {
+	if len(args[i]) != 1 {
+		return 0, fmt.Errorf("%s needs a single value for argument %d, got %d values", name, i+1, len(args[i]))
+	}
+	return args[i][0], nil
+}
+
+// bounds returns the min and max arguments of name.
+func bounds(name string, args [][]float64) (min, max float64, err error) {
+	if min, err = single(name, args, 0); err != nil {
+		return
+	}
+	if max, err = single(name, args, 1); err != nil {
+		return
+	}
+	if !(min <= max) || math.IsInf(max-min, 0) {
+		err = fmt.Errorf("%s needs min <= max, got %v, %v", name, min, max)
+	}
+	return
+}
+
+func random(s scope, args [][]float64) ([]float64, error) {
+	min, max, err := bounds("rand", args)
+	if err != nil {
+		return nil, err
+	}
+	return []float64{min + s.rng.Float64()*(max-min)}, nil
+}
+
+func randi(s scope, args [][]float64) ([]float64, error) {
+	min, err := whole("randi", args, 0)
+	if err != nil {
+		return nil, err
+	}
+	max, err := whole("randi", args, 1)
+	if err != nil {
+		return nil, err
+	}
+	if min > max {
+		return nil, fmt.Errorf("randi needs min <= max, got %d, %d", min, max)
+	}
+	return []float64{float64(min + s.rng.IntN(max-min+1))}, nil
+}
+
+func chance(s scope, args [][]float64) ([]float64, error) {
+	p, err := single("chance", args, 0)
+	if err != nil {
+		return nil, err
+	}
+	if !(p >= 0 && p <= 1) {
+		return nil, fmt.Errorf("chance needs a probability between 0 and 1, got %v", p)
+	}
+	if s.rng.Float64() < p {
+		return []float64{1}, nil
+	}
+	return []float64{0}, nil
+}
+
+func jitter(s scope, args [][]float64) ([]float64, error) {
+	amount, err := single("jitter", args, 1)
+	if err != nil {
+		return nil, err
+	}
+	if !(amount >= 0) || math.IsInf(amount, 0) {
+		return nil, fmt.Errorf("jitter needs an amount of at least 0, got %v", amount)
+	}
+	out := make([]float64, len(args[0]))
+	for i, v := range args[0] {
+		out[i] = v + (2*s.rng.Float64()-1)*amount
+	}
+	return out, nil
+}
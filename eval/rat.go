@@ -0,0 +1,502 @@
+package eval
+
+import (
+	"fmt"
+	"math"
+	"math/big"
+	"slices"
+)
+
+// EvalRat evaluates the macro expression s exactly, with rational numbers
+// instead of float64: 1/3 is exactly a third, "0 % 0.33 0 2" steps by
+// exactly 0.33 and \ removes only equal elements. Registered operators
+// and functions, and the random functions, compute with float64; their
+// arguments and results are converted where they are called.
+func EvalRat(s string, opts ...Option) ([]*big.Rat, error) {
+	return EvalRatMax(s, 0, opts...)
+}
+
+// EvalRatMax is like EvalRat, but stops with a *LengthError as soon as
+// the expression, or any part of it, expands to more than max values.
+func EvalRatMax(s string, max int, opts ...Option) ([]*big.Rat, error) {
+	e, err := Compile(s, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return e.EvalRatMax(max)
+}
+
+// EvalRat evaluates e exactly, like the function EvalRat.
+func (e *Expr) EvalRat() ([]*big.Rat, error) {
+	return e.EvalRatMax(0)
+}
+
+// EvalRatMax is like EvalRat, but stops with a *LengthError as soon as e,
+// or any part of it, expands to more than max values.
+func (e *Expr) EvalRatMax(max int) ([]*big.Rat, error) {
+	out, err := evaluateRat(e.root, newScope(max, e.seed))
+	if err != nil {
+		return nil, err
+	}
+	// Elements may share a value, as for "1 * 4"; give each its own.
+	for i, r := range out {
+		out[i] = new(big.Rat).Set(r)
+	}
+	return out, nil
+}
+
+// floats converts rs to float64 values, for the edge of exact evaluation.
+func floats(rs []*big.Rat) []float64 {
+	out := make([]float64, len(rs))
+	for i, r := range rs {
+		out[i], _ = r.Float64()
+	}
+	return out
+}
+
+// rats converts vs to rational numbers.
+func rats(vs []float64) ([]*big.Rat, error) {
+	out := make([]*big.Rat, len(vs))
+	for i, v := range vs {
+		if out[i] = new(big.Rat).SetFloat64(v); out[i] == nil {
+			return nil, fmt.Errorf("%v has no exact value", v)
+		}
+	}
+	return out, nil
+}
+
+// evaluateRat is the exact form of evaluate. Inside a mapping x is bound
+// to s.rx.
+func evaluateRat(n Node, s scope) ([]*big.Rat, error) {
+	switch v := n.(type) {
+	case *Value:
+		r, ok := new(big.Rat).SetString(string(v.Tok))
+		if !ok {
+			return nil, fmt.Errorf("invalid number %s", v.Tok)
+		}
+		return []*big.Rat{r}, nil
+	case *Operator:
+		return v.evaluateRat(s)
+	case *List:
+		var out []*big.Rat
+		for _, num := range v.Nums {
+			rs, err := evaluateRat(num, s)
+			if err != nil {
+				return nil, err
+			}
+			if err := checkLength(len(out)+len(rs), s.limit); err != nil {
+				return nil, err
+			}
+			out = append(out, rs...)
+		}
+		return out, nil
+	case *Range:
+		return v.evaluateRat(s)
+	case *Unary:
+		x, err := evaluateRat(v.X, s)
+		if err != nil {
+			return nil, err
+		}
+		if v.Op != "-" {
+			return nil, errorAt(v.Col, "operator %s is not supported", v.Op)
+		}
+		out := make([]*big.Rat, len(x))
+		for i, r := range x {
+			out[i] = new(big.Rat).Neg(r)
+		}
+		return out, nil
+	case *Call:
+		return v.evaluateRat(s)
+	case *Group:
+		return evaluateRat(v.Child, s)
+	case *Placeholder:
+		if !s.bound {
+			return nil, errorAt(v.Col, "x outside of a mapping")
+		}
+		return []*big.Rat{s.rx}, nil
+	}
+	return rats(n.Evaluate())
+}
+
+// streamRat is the exact form of stream. Lists, ranges, mappings and the
+// operators with a ratStream compute their values one at a time, and
+// everything else is evaluated in full with evaluateRat.
+func streamRat(n Node, s scope, yield func(*big.Rat) bool) (bool, error) {
+	switch v := n.(type) {
+	case *List:
+		for _, num := range v.Nums {
+			if more, err := streamRat(num, s, yield); !more || err != nil {
+				return false, err
+			}
+		}
+		return true, nil
+	case *Range:
+		return v.streamRat(s, yield)
+	case *Operator:
+		return v.streamRat(s, yield)
+	case *Group:
+		return streamRat(v.Child, s, yield)
+	}
+	out, err := evaluateRat(n, s)
+	if err != nil {
+		return false, err
+	}
+	return yieldAllRat(out, yield), nil
+}
+
+// limitedRat is the exact form of limited.
+func limitedRat(n Node, s scope, yield func(*big.Rat) bool) (bool, error) {
+	count := 0
+	var lerr error
+	more, err := streamRat(n, s, func(r *big.Rat) bool {
+		count++
+		if lerr = checkLength(count, s.limit); lerr != nil {
+			return false
+		}
+		return yield(r)
+	})
+	if err == nil {
+		err = lerr
+	}
+	return more, err
+}
+
+// forEachRat is the exact form of forEach.
+func forEachRat(n Node, s scope, f func(r *big.Rat) (bool, error)) (bool, error) {
+	var ferr error
+	more, err := streamRat(n, s, func(r *big.Rat) bool {
+		var more bool
+		more, ferr = f(r)
+		return more && ferr == nil
+	})
+	if err == nil {
+		err = ferr
+	}
+	return more && err == nil, err
+}
+
+func yieldAllRat(rs []*big.Rat, yield func(*big.Rat) bool) bool {
+	for _, r := range rs {
+		if !yield(r) {
+			return false
+		}
+	}
+	return true
+}
+
+func (n *Operator) streamRat(s scope, yield func(*big.Rat) bool) (bool, error) {
+	if n.Op == ":" {
+		left, err := evaluateRat(n.LHS, s)
+		if err != nil {
+			return false, err
+		}
+		for _, x := range left {
+			inner := s
+			inner.rx, inner.bound = x, true
+			if more, err := streamRat(n.RHS, inner, yield); !more || err != nil {
+				return false, err
+			}
+		}
+		return true, nil
+	}
+	if op, err := n.resolve(); err == nil && op.ratStream != nil {
+		more, err := op.ratStream(s, n.LHS, n.RHS, yield)
+		return more, wrap(n.Col, err)
+	}
+	out, err := n.evaluateRat(s)
+	if err != nil {
+		return false, err
+	}
+	return yieldAllRat(out, yield), nil
+}
+
+func (n *Operator) evaluateRat(s scope) (out []*big.Rat, err error) {
+	left, err := evaluateRat(n.LHS, s)
+	if err != nil {
+		return nil, err
+	}
+	if n.Op == ":" {
+		for _, x := range left {
+			inner := s
+			inner.rx, inner.bound = x, true
+			rs, err := evaluateRat(n.RHS, inner)
+			if err != nil {
+				return nil, err
+			}
+			if err := checkLength(len(out)+len(rs), s.limit); err != nil {
+				return nil, err
+			}
+			out = append(out, rs...)
+		}
+		return out, nil
+	}
+	right, err := evaluateRat(n.RHS, s)
+	if err != nil {
+		return nil, err
+	}
+
+	op, err := n.resolve()
+	if err != nil {
+		return nil, err
+	}
+	if op.rat != nil {
+		out, err = op.rat(left, right, s.limit)
+		return out, wrap(n.Col, err)
+	}
+	vs, err := op.fn(floats(left), floats(right), s.limit)
+	if err == nil {
+		out, err = rats(vs)
+	}
+	return out, wrap(n.Col, err)
+}
+
+func (n *Call) evaluateRat(s scope) (out []*big.Rat, err error) {
+	f, err := n.resolve()
+	if err != nil {
+		return nil, err
+	}
+	args := make([][]*big.Rat, len(n.Args))
+	for i, arg := range n.Args {
+		if args[i], err = evaluateRat(arg, s); err != nil {
+			return nil, err
+		}
+	}
+
+	switch {
+	case f.rat != nil:
+		out, err = f.rat(s, args)
+	case f.picks && len(args) > 0:
+		// Pick by position: the function sees 0, 1, 2, ... as its first
+		// argument.
+		fargs := make([][]float64, len(args))
+		fargs[0] = make([]float64, len(args[0]))
+		for i := range fargs[0] {
+			fargs[0][i] = float64(i)
+		}
+		for i, arg := range args[1:] {
+			fargs[i+1] = floats(arg)
+		}
+		var picked []float64
+		if picked, err = f.fn(s, fargs); err == nil {
+			out = make([]*big.Rat, len(picked))
+			for i, p := range picked {
+				out[i] = args[0][int(p)]
+			}
+		}
+	default:
+		fargs := make([][]float64, len(args))
+		for i, arg := range args {
+			fargs[i] = floats(arg)
+		}
+		var vs []float64
+		if vs, err = f.fn(s, fargs); err == nil {
+			out, err = rats(vs)
+		}
+	}
+	return out, wrap(n.Col, err)
+}
+
+func (n *Range) evaluateRat(s scope) ([]*big.Rat, error) {
+	from, step, count, err := n.boundsRat(s)
+	if err != nil {
+		return nil, err
+	}
+	if err := checkLength(count, s.limit); err != nil {
+		return nil, err
+	}
+	out := make([]*big.Rat, count)
+	for i := range out {
+		out[i] = n.at(from, step, i)
+	}
+	return out, nil
+}
+
+// streamRat is the exact form of stream.
+func (n *Range) streamRat(s scope, yield func(*big.Rat) bool) (bool, error) {
+	from, step, count, err := n.boundsRat(s)
+	if err != nil {
+		return false, err
+	}
+	for i := 0; i < count; i++ {
+		if !yield(n.at(from, step, i)) {
+			return false, nil
+		}
+	}
+	return true, nil
+}
+
+// boundsRat returns the first value, the step and the length of n.
+func (n *Range) boundsRat(s scope) (from, step *big.Rat, count int, err error) {
+	from, err = n.singleRat(n.From, "start", s)
+	if err != nil {
+		return nil, nil, 0, err
+	}
+	to, err := n.singleRat(n.To, "end", s)
+	if err != nil {
+		return nil, nil, 0, err
+	}
+	step = big.NewRat(1, 1)
+	if n.Step != nil {
+		if step, err = n.singleRat(n.Step, "step", s); err != nil {
+			return nil, nil, 0, err
+		}
+		step = new(big.Rat).Abs(step)
+		if step.Sign() == 0 {
+			return nil, nil, 0, errorAt(n.Col, "range needs a non-zero step, got 0")
+		}
+	}
+	if to.Cmp(from) < 0 {
+		step = new(big.Rat).Neg(step)
+	}
+
+	span := new(big.Rat).Quo(new(big.Rat).Sub(to, from), step)
+	c := floor(span)
+	if !n.Exclusive || !span.IsInt() {
+		c.Add(c, big.NewInt(1))
+	}
+	if !c.IsInt64() || c.Int64() > math.MaxInt32 {
+		return nil, nil, 0, errorAt(n.Col, "range from %s to %s is too long", from.RatString(), to.RatString())
+	}
+	return from, step, int(c.Int64()), nil
+}
+
+// at returns the i-th value of a range.
+func (n *Range) at(from, step *big.Rat, i int) *big.Rat {
+	r := new(big.Rat).Mul(step, new(big.Rat).SetInt64(int64(i)))
+	return r.Add(r, from)
+}
+
+// singleRat is the exact form of single.
+func (n *Range) singleRat(b Node, what string, s scope) (*big.Rat, error) {
+	v, err := evaluateRat(b, s)
+	if err != nil {
+		return nil, err
+	}
+	if len(v) != 1 {
+		return nil, errorAt(n.Col, "range %s must be a single value, got %d", what, len(v))
+	}
+	return v[0], nil
+}
+
+// floor returns the greatest integer not greater than r.
+func floor(r *big.Rat) *big.Int {
+	// Div rounds towards negative infinity for a positive divisor, and
+	// the denominator of a Rat is always positive.
+	return new(big.Int).Div(r.Num(), r.Denom())
+}
+
+func addRat(left, right []*big.Rat, limit int) ([]*big.Rat, error) {
+	return broadcast(left, right, limit, func(x, y *big.Rat) *big.Rat { return new(big.Rat).Add(x, y) })
+}
+
+func subRat(left, right []*big.Rat, limit int) ([]*big.Rat, error) {
+	return broadcast(left, right, limit, func(x, y *big.Rat) *big.Rat { return new(big.Rat).Sub(x, y) })
+}
+
+func modRat(left, right []*big.Rat, limit int) (out []*big.Rat, err error) {
+	if len(right) != 3 {
+		return nil, fmt.Errorf("%% needs a modulus, min and max, got %d values", len(right))
+	}
+	mod := right[0]
+	min := right[1]
+	max := right[2]
+	if mod.Sign() <= 0 {
+		return nil, fmt.Errorf("%% needs a positive modulus, got %s", mod.RatString())
+	}
+	for _, v := range left {
+		// v - min - floor((v - min) / mod) * mod, which is in [0, mod).
+		d := new(big.Rat).Sub(v, min)
+		q := new(big.Rat).SetInt(floor(new(big.Rat).Quo(d, mod)))
+		v = d.Sub(d, q.Mul(q, mod))
+		for v.Add(v, min); v.Cmp(max) < 0; v = new(big.Rat).Add(v, mod) {
+			if err := checkLength(len(out)+1, limit); err != nil {
+				return nil, err
+			}
+			out = append(out, v)
+		}
+	}
+	return out, nil
+}
+
+func repRatStream(s scope, l, r Node, yield func(*big.Rat) bool) (bool, error) {
+	left, err := evaluateRat(l, s)
+	if err != nil {
+		return false, err
+	}
+	return forEachRat(r, s, func(count *big.Rat) (bool, error) {
+		c, err := repCount(count)
+		if err != nil {
+			return false, err
+		}
+		for _, x := range left {
+			for i := 0; i < c; i++ {
+				if !yield(x) {
+					return false, nil
+				}
+			}
+		}
+		return true, nil
+	})
+}
+
+func concatRatStream(s scope, l, r Node, yield func(*big.Rat) bool) (bool, error) {
+	if more, err := streamRat(l, s, yield); !more || err != nil {
+		return false, err
+	}
+	return streamRat(r, s, yield)
+}
+
+// repCount returns how often * repeats its left side for count.
+func repCount(count *big.Rat) (int, error) {
+	if count.Sign() < 0 {
+		return 0, fmt.Errorf("* needs counts of at least 0, got %s", count.RatString())
+	}
+	if n := floor(count); n.IsInt64() && n.Int64() < math.MaxInt32 {
+		return int(n.Int64()), nil
+	}
+	return math.MaxInt32, nil
+}
+
+func repRat(left, right []*big.Rat, limit int) (out []*big.Rat, err error) {
+	for _, count := range right {
+		c, err := repCount(count)
+		if err != nil {
+			return nil, err
+		}
+		for _, x := range left {
+			if err := checkLength(len(out)+c, limit); err != nil {
+				return nil, err
+			}
+			for i := 0; i < c; i++ {
+				out = append(out, x)
+			}
+		}
+	}
+	return out, nil
+}
+
+func excludeRat(left, right []*big.Rat, limit int) (out []*big.Rat, err error) {
+	for _, v := range left {
+		if !slices.ContainsFunc(right, func(w *big.Rat) bool { return v.Cmp(w) == 0 }) {
+			out = append(out, v)
+		}
+	}
+	return out, nil
+}
+
+func stretchRat(s scope, args [][]*big.Rat) ([]*big.Rat, error) {
+	if len(args[1]) != 1 {
+		return nil, fmt.Errorf("stretch needs a single factor, got %d values", len(args[1]))
+	}
+	out := make([]*big.Rat, len(args[0]))
+	for i, r := range args[0] {
+		out[i] = new(big.Rat).Mul(r, args[1][0])
+	}
+	return out, nil
+}
+
+func sortRat(s scope, args [][]*big.Rat) ([]*big.Rat, error) {
+	out := slices.Clone(args[0])
+	slices.SortStableFunc(out, (*big.Rat).Cmp)
+	return out, nil
+}
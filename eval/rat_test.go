@@ -0,0 +1,66 @@
+package eval_test
+
+import (
+	"fmt"
+	"math/big"
+	"strings"
+	"testing"
+
+	"github.com/dianelooney/directive/eval"
+)
+
+func ratStrings(rs []*big.Rat) string {
+	strs := make([]string, len(rs))
+	for i, r := range rs {
+		strs[i] = r.RatString()
+	}
+	return strings.Join(strs, " ")
+}
+
+func TestEvalRat(t *testing.T) {
+	cases := map[string]string{
+		`1/3 2/3 % 1 0 2`:              "1/3 4/3 2/3 5/3",
+		`0 % 0.33 0 1`:                 "0 33/100 33/50 99/100",
+		`0..1 step 1/3`:                "0 1/3 2/3 1",
+		`0..<1 step 1/3`:               "0 1/3 2/3",
+		`1..0 step 0.25`:               "1 3/4 1/2 1/4 0",
+		`1 2 - 3 4`:                    "-2 -1 -3 -2",
+		`-1/3 * 2`:                     "-1/3 -1/3",
+		`0..3 \ 1/3 + 2/3`:             "0 2 3",
+		`1/3 2/3 : x + 1`:              "4/3 5/3",
+		`0 1 & 1/2`:                    "0 1/2 1",
+		`rev(1/3 2/3) | sort(1/2 1/4)`: "2/3 1/3 1/4 1/2",
+		`stretch(euclid(3, 8), 1/8)`:   "0 3/8 3/4",
+		`take(rot(1/3 2/3 1, 1), 2)`:   "2/3 1",
+		`(0 % 1 0 4) | 8`:              "0 1 2 3 8",
+	}
+	for s, expected := range cases {
+		out, err := eval.EvalRat(s)
+		if err != nil {
+			t.Errorf("%s: %v", s, err)
+			continue
+		}
+		if actual := ratStrings(out); actual != expected {
+			t.Errorf("%s: expected %s but got %s", s, expected, actual)
+		}
+	}
+
+	out := eval.Eval(`0 % 0.33 0 2`, eval.Exact())
+	if fmt.Sprint(out) != "[0 0.33 0.66 0.99 1.32 1.65 1.98]" {
+		t.Errorf("Expected exact steps of 0.33 but got %v", out)
+	}
+	if _, err := eval.EvalRatMax(`0 * 100000000`, 1000); err == nil {
+		t.Errorf("Expected a length error")
+	}
+	if _, err := eval.EvalRat(`0..1 step (1 - 1)`); err == nil || err.Error() != "column 2: range needs a non-zero step, got 0" {
+		t.Errorf("Expected a step error but got %v", err)
+	}
+
+	r := eval.NewRegistry()
+	r.RegisterFunction("half", func(args ...[]float64) ([]float64, error) {
+		return []float64{args[0][0] / 2}, nil
+	})
+	if out, err := eval.EvalRat(`half(3)`, eval.WithRegistry(r)); err != nil || ratStrings(out) != "3/2" {
+		t.Errorf("Expected registered functions to be converted, got %v, %v", out, err)
+	}
+}
@@ -0,0 +1,254 @@
+package eval
+
+import (
+	"fmt"
+	"math/big"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"unicode"
+)
+
+// Assoc is the associativity of a binary operator: how operators of the
+// same precedence group when written one after another.
+type Assoc uint8
+
+const (
+	// Left groups "a op b op c" as "(a op b) op c".
+	Left Assoc = iota
+	// Right groups "a op b op c" as "a op (b op c)".
+	Right
+)
+
+// OperatorFunc computes a binary operator from the values of its operands.
+type OperatorFunc func(l, r []float64) ([]float64, error)
+
+// Function computes a function call from the values of its arguments.
+type Function func(args ...[]float64) ([]float64, error)
+
+// operator is a registered binary operator. The built-in operators
+// stream their values; registered ones compute them with fn from the
+// values of both operands. Operators the parser builds its own nodes for,
+// such as ranges and mappings, have neither. rat, if set, computes the
+// operator exactly; otherwise exact evaluation converts the operands to
+// float64 for fn. ratStream, if set, streams the exact values.
+type operator struct {
+	power     int
+	assoc     Assoc
+	fn        func(l, r []float64, limit int) ([]float64, error)
+	stream    func(s scope, l, r Node, yield func(float64) bool) (bool, error)
+	rat       func(l, r []*big.Rat, limit int) ([]*big.Rat, error)
+	ratStream func(s scope, l, r Node, yield func(*big.Rat) bool) (bool, error)
+}
+
+// function is a registered function. rat, if set, computes it exactly.
+// Functions that picks are set for only pick elements of their first
+// argument, so exact evaluation runs fn on the positions of the elements
+// and picks the exact elements at the positions it returns. Other
+// functions get their arguments as float64.
+type function struct {
+	fn    func(s scope, args [][]float64) ([]float64, error)
+	rat   func(s scope, args [][]*big.Rat) ([]*big.Rat, error)
+	picks bool
+}
+
+// Registry holds the operators and functions expressions may use. The
+// tokenizer, the parser's precedence table and the evaluation of Operator
+// and Call nodes are all driven by it. A Registry is safe for concurrent
+// use.
+type Registry struct {
+	mu    sync.RWMutex
+	ops   map[string]operator
+	funcs map[string]function
+	tkn   *regexp.Regexp
+}
+
+// defaultRegistry is set in init: evaluation refers to it, and the
+// built-in operators refer to evaluation.
+var defaultRegistry *Registry
+
+func init() {
+	defaultRegistry = NewRegistry()
+}
+
+// NewRegistry returns a registry with the built-in operators and
+// functions.
+func NewRegistry() *Registry {
+	r := &Registry{ops: map[string]operator{}, funcs: map[string]function{}}
+	for symbol, op := range builtinOperators {
+		r.ops[symbol] = op
+	}
+	for name, f := range builtinFunctions {
+		r.funcs[name] = f
+	}
+	r.build()
+	return r
+}
+
+// RegisterOperator adds a binary operator to the default registry. See
+// Registry.RegisterOperator.
+func RegisterOperator(symbol string, precedence int, assoc Assoc, fn OperatorFunc) {
+	defaultRegistry.RegisterOperator(symbol, precedence, assoc, fn)
+}
+
+// RegisterFunction adds a function to the default registry. See
+// Registry.RegisterFunction.
+func RegisterFunction(name string, fn Function) {
+	defaultRegistry.RegisterFunction(name, fn)
+}
+
+// RegisterOperator adds the binary operator symbol. precedence orders it
+// among the built-in operators, which use:
+//
+//	10  :
+//	20  \
+//	30  %
+//	40  + -
+//	50  * & |
+//	60  operands written next to each other
+//	70  step
+//	80  .. ..< …
+//
+// symbol may not contain letters, digits, white space, parens or commas.
+// RegisterOperator panics if symbol is invalid or already registered.
+func (r *Registry) RegisterOperator(symbol string, precedence int, assoc Assoc, fn OperatorFunc) {
+	if symbol == "" || strings.IndexFunc(symbol, func(c rune) bool {
+		return unicode.IsLetter(c) || unicode.IsDigit(c) || unicode.IsSpace(c) || strings.ContainsRune("(),", c)
+	}) >= 0 {
+		panic(fmt.Sprintf("eval: invalid operator symbol %q", symbol))
+	}
+	if precedence <= 0 {
+		panic(fmt.Sprintf("eval: operator %s needs a positive precedence", symbol))
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if _, dup := r.ops[symbol]; dup {
+		panic("eval: RegisterOperator called twice for " + symbol)
+	}
+	r.ops[symbol] = operator{power: precedence, assoc: assoc, fn: func(l, r []float64, limit int) ([]float64, error) {
+		out, err := fn(l, r)
+		if err != nil {
+			return nil, err
+		}
+		return out, checkLength(len(out), limit)
+	}}
+	r.build()
+}
+
+// RegisterFunction adds the function name, called as name(arg, ...) with
+// every argument evaluated to a sequence. name must be an identifier
+// other than x and step. RegisterFunction panics if name is invalid or
+// already registered.
+func (r *Registry) RegisterFunction(name string, fn Function) {
+	if !identifier.MatchString(name) || name == "x" || name == "step" {
+		panic(fmt.Sprintf("eval: invalid function name %q", name))
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if _, dup := r.funcs[name]; dup {
+		panic("eval: RegisterFunction called twice for " + name)
+	}
+	r.funcs[name] = function{fn: func(s scope, args [][]float64) ([]float64, error) {
+		out, err := fn(args...)
+		if err != nil {
+			return nil, err
+		}
+		return out, checkLength(len(out), s.limit)
+	}}
+}
+
+func (r *Registry) operator(symbol string) (operator, bool) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	op, ok := r.ops[symbol]
+	return op, ok
+}
+
+func (r *Registry) function(name string) (function, bool) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	f, ok := r.funcs[name]
+	return f, ok
+}
+
+func (r *Registry) tokenizer() *regexp.Regexp {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.tkn
+}
+
+var identifier = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+// build compiles the tokenizer for r's operators. Longer symbols come
+// first so that ">>" is not read as two ">".
+func (r *Registry) build() {
+	var symbols []string
+	for s := range r.ops {
+		if identifier.MatchString(s) {
+			continue
+		}
+		symbols = append(symbols, s)
+	}
+	sort.Slice(symbols, func(i, j int) bool {
+		if len(symbols[i]) != len(symbols[j]) {
+			return len(symbols[i]) > len(symbols[j])
+		}
+		return symbols[i] < symbols[j]
+	})
+
+	alts := []string{`[0-9]+/[0-9]+`, `[0-9]+(?:\.[0-9]*)?`, `[A-Za-z_][A-Za-z0-9_]*`}
+	for _, s := range symbols {
+		alts = append(alts, regexp.QuoteMeta(s))
+	}
+	alts = append(alts, `\(`, `\)`, `,`)
+	r.tkn = regexp.MustCompile(`^(?:` + strings.Join(alts, `|`) + `)`)
+}
+
+// Option configures Compile and the Eval functions.
+type Option func(*options)
+
+type options struct {
+	reg   *Registry
+	seed  uint64
+	exact bool
+}
+
+// WithRegistry makes expressions use the operators and functions of r
+// instead of the default registry.
+func WithRegistry(r *Registry) Option {
+	return func(o *options) {
+		o.reg = r
+	}
+}
+
+// WithSeed seeds the random functions, such as rand and chance. Without
+// it they are seeded with 0: an expression always evaluates to the same
+// values.
+func WithSeed(seed uint64) Option {
+	return func(o *options) {
+		o.seed = seed
+	}
+}
+
+// Exact makes Eval and EvalMax compute with rational numbers like
+// EvalRat, converting to float64 only at the end: "0 % 0.33 0 2" then
+// steps by exactly 0.33.
+func Exact() Option {
+	return func(o *options) {
+		o.exact = true
+	}
+}
+
+func newOptions(opts []Option) options {
+	o := options{reg: defaultRegistry}
+	for _, opt := range opts {
+		opt(&o)
+	}
+	if o.reg == nil {
+		o.reg = defaultRegistry
+	}
+	return o
+}
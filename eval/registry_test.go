@@ -0,0 +1,102 @@
+package eval_test
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/dianelooney/directive/eval"
+)
+
+func newRegistry() *eval.Registry {
+	r := eval.NewRegistry()
+	r.RegisterOperator(">>", 45, eval.Left, func(l, r []float64) ([]float64, error) {
+		if len(r) != 1 {
+			return nil, fmt.Errorf(">> needs a single count, got %d values", len(r))
+		}
+		n := int(r[0]) % len(l)
+		return append(l[len(l)-n:len(l):len(l)], l[:len(l)-n]...), nil
+	})
+	r.RegisterOperator("^", 55, eval.Right, func(l, r []float64) ([]float64, error) {
+		return []float64{l[0] * r[0]}, nil
+	})
+	r.RegisterFunction("sum", func(args ...[]float64) ([]float64, error) {
+		total := 0.0
+		for _, arg := range args {
+			for _, v := range arg {
+				total += v
+			}
+		}
+		return []float64{total}, nil
+	})
+	return r
+}
+
+func TestRegistry(t *testing.T) {
+	r := newRegistry()
+	cases := map[string][]float64{
+		`0 1 2 3 >> 1`:       {3, 0, 1, 2},
+		`0 1 2 3 >> 1 + 1`:   {4, 1, 2, 3},
+		`sum(1 2, 3)`:        {6},
+		`0 sum(0..3) 9`:      {0, 6, 9},
+		`1 2 : sum(x, x, 1)`: {3, 5},
+		`2 ^ 3 ^ 4`:          {24},
+		`sum()`:              {0},
+	}
+	for s, expected := range cases {
+		out, err := eval.EvalE(s, eval.WithRegistry(r))
+		if err != nil {
+			t.Errorf("%s: %v", s, err)
+			continue
+		}
+		if fmt.Sprint(out) != fmt.Sprint(expected) {
+			t.Errorf("%s: expected %v but got %v", s, expected, out)
+		}
+	}
+}
+
+func TestRegistry_Errors(t *testing.T) {
+	r := newRegistry()
+	cases := map[string]string{
+		`0 1 >> 1 2`:   "column 5: >> needs a single count, got 2 values",
+		`sum(1, 2`:     "column 4: unclosed (",
+		`sum(1,)`:      "column 6: missing argument after ,",
+		`sum 1`:        "column 1: sum needs (",
+		`max(1)`:       "column 1: unknown function max",
+		`0 1 2 3 >> 1`: "",
+	}
+	for s, expected := range cases {
+		_, err := eval.EvalE(s, eval.WithRegistry(r))
+		if expected == "" && err != nil {
+			t.Errorf("%s: EvalE returned an error: %v", s, err)
+		}
+		if expected != "" && (err == nil || err.Error() != expected) {
+			t.Errorf("%s: expected error %q but got %v", s, expected, err)
+		}
+	}
+
+	if _, err := eval.EvalE(`0 1 >> 1`); err == nil {
+		t.Errorf("Expected >> to be unknown to the default registry")
+	}
+	if _, err := eval.EvalMax(`sum(1) 1 2`, 2, eval.WithRegistry(r)); err == nil {
+		t.Errorf("Expected a length error")
+	}
+}
+
+func TestRegistry_Invalid(t *testing.T) {
+	r := newRegistry()
+	for name, fn := range map[string]func(){
+		"symbol":    func() { r.RegisterOperator("a+", 1, eval.Left, nil) },
+		"duplicate": func() { r.RegisterOperator("+", 1, eval.Left, nil) },
+		"x":         func() { r.RegisterFunction("x", nil) },
+		"twice":     func() { r.RegisterFunction("sum", nil) },
+	} {
+		func() {
+			defer func() {
+				if recover() == nil {
+					t.Errorf("%s: expected a panic", name)
+				}
+			}()
+			fn()
+		}()
+	}
+}
@@ -0,0 +1,141 @@
+package eval
+
+import (
+	"iter"
+	"math/big"
+)
+
+// Stream is the values of an expression, computed one at a time as they
+// are read instead of all at once: reading the first values of
+// "0 * 100000000" does not repeat the 0 a hundred million times.
+//
+// Operands that have to be known in full, such as the left side of + or
+// the arguments of a function, are still evaluated into memory, and
+// count against the length limit like the values read.
+type Stream struct {
+	e   *Expr
+	max int
+	err error
+}
+
+// Stream returns the values of e as a stream that fails with a
+// *LengthError as soon as more than max values are read, or any part of e
+// expands to more than max values. A max of 0 is unlimited.
+func (e *Expr) Stream(max int) *Stream {
+	return &Stream{e: e, max: max}
+}
+
+// All returns an iterator over the values of the stream. Every iteration
+// evaluates the expression again, and stops at the first error, which Err
+// then returns.
+//
+// Exact expressions stream lists, ranges, mappings, * and | the same way,
+// and compute other operators and functions in full.
+func (st *Stream) All() iter.Seq[float64] {
+	return func(yield func(float64) bool) {
+		s := newScope(st.max, st.e.seed)
+		if st.e.exact {
+			_, st.err = limitedRat(st.e.root, s, func(r *big.Rat) bool {
+				f, _ := r.Float64()
+				return yield(f)
+			})
+			return
+		}
+		_, st.err = limited(st.e.root, s, yield)
+	}
+}
+
+// Err returns the error that stopped the last iteration, if any.
+func (st *Stream) Err() error {
+	return st.err
+}
+
+// stream calls yield with the values of n in order, computing each only
+// when it is needed, until yield returns false. It reports whether yield
+// wants more values.
+func stream(n Node, s scope, yield func(float64) bool) (bool, error) {
+	switch v := n.(type) {
+	case *Value:
+		f, err := v.Tok.float()
+		if err != nil {
+			return false, err
+		}
+		return yield(f), nil
+	case *Operator:
+		return v.stream(s, yield)
+	case *List:
+		return v.stream(s, yield)
+	case *Range:
+		return v.stream(s, yield)
+	case *Unary:
+		return v.stream(s, yield)
+	case *Call:
+		return v.stream(s, yield)
+	case *Group:
+		return stream(v.Child, s, yield)
+	case *Placeholder:
+		if !s.bound {
+			return false, errorAt(v.Col, "x outside of a mapping")
+		}
+		return yield(s.x), nil
+	case Streamer:
+		return v.Stream(yield), nil
+	}
+	return yieldAll(n.Evaluate(), yield), nil
+}
+
+// limited is like stream, but fails with a *LengthError once n yields
+// more than s.limit values.
+func limited(n Node, s scope, yield func(float64) bool) (bool, error) {
+	count := 0
+	var lerr error
+	more, err := stream(n, s, func(x float64) bool {
+		count++
+		if lerr = checkLength(count, s.limit); lerr != nil {
+			return false
+		}
+		return yield(x)
+	})
+	if err == nil {
+		err = lerr
+	}
+	return more, err
+}
+
+// collect evaluates n into memory, failing with a *LengthError if it has
+// more than s.limit values.
+func collect(n Node, s scope) (out []float64, err error) {
+	_, err = limited(n, s, func(x float64) bool {
+		out = append(out, x)
+		return true
+	})
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// forEach streams n, calling f with each value until f returns false or
+// an error.
+func forEach(n Node, s scope, f func(x float64) (bool, error)) (bool, error) {
+	var ferr error
+	more, err := stream(n, s, func(x float64) bool {
+		var more bool
+		more, ferr = f(x)
+		return more && ferr == nil
+	})
+	if err == nil {
+		err = ferr
+	}
+	return more && err == nil, err
+}
+
+// yieldAll yields vs in order and reports whether yield wants more.
+func yieldAll(vs []float64, yield func(float64) bool) bool {
+	for _, v := range vs {
+		if !yield(v) {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,98 @@
+package eval_test
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+
+	"github.com/dianelooney/directive/eval"
+)
+
+func TestStream(t *testing.T) {
+	for _, s := range []string{
+		`0 1 2 + 10 20`,
+		`0 % 0.5 0 2 \ 1`,
+		`0 1 * 2 3`,
+		`0 1 2 & 10`,
+		`0 & 10 11 12`,
+		`0..3 | -1 : x * 2`,
+		`euclid(3, 8) : x + rand(0, 1)`,
+	} {
+		for _, exact := range []bool{false, true} {
+			opts := []eval.Option{eval.WithSeed(3)}
+			if exact {
+				opts = append(opts, eval.Exact())
+			}
+			e, err := eval.Compile(s, opts...)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var out []float64
+			st := e.Stream(0)
+			for v := range st.All() {
+				out = append(out, v)
+			}
+			expected, _ := e.Eval()
+			if st.Err() != nil || fmt.Sprint(out) != fmt.Sprint(expected) {
+				t.Errorf("%s (exact %v): expected %v but streamed %v, %v", s, exact, expected, out, st.Err())
+			}
+		}
+	}
+}
+
+func TestStream_Lazy(t *testing.T) {
+	for _, opts := range [][]eval.Option{nil, {eval.Exact()}} {
+		for _, s := range []string{`0 * 1000000000`, `1 | 0..1000000000`} {
+			e, err := eval.Compile(s, opts...)
+			if err != nil {
+				t.Fatal(err)
+			}
+			n := 0
+			st := e.Stream(0)
+			for range st.All() {
+				if n++; n == 3 {
+					break
+				}
+			}
+			if n != 3 || st.Err() != nil {
+				t.Errorf("%s: expected to read 3 values, read %d: %v", s, n, st.Err())
+			}
+
+			st = e.Stream(10)
+			n = 0
+			for range st.All() {
+				n++
+			}
+			var lerr *eval.LengthError
+			if n != 10 || !errors.As(st.Err(), &lerr) {
+				t.Errorf("%s: expected a length error after 10 values, got %d: %v", s, n, st.Err())
+			}
+		}
+	}
+}
+
+// naturals is a Node outside the package that streams 0, 1, 2, ... and
+// cannot be evaluated in full.
+type naturals struct{}
+
+func (naturals) Evaluate() []float64 { panic("naturals evaluated in full") }
+
+func (naturals) Stream(yield func(float64) bool) bool {
+	for i := 0; ; i++ {
+		if !yield(float64(i)) {
+			return false
+		}
+	}
+}
+
+func TestStream_Streamer(t *testing.T) {
+	n := &eval.List{Nums: []eval.Node{&eval.Value{Tok: "-1"}, &eval.Group{Child: naturals{}}}}
+	var out []float64
+	n.Stream(func(v float64) bool {
+		out = append(out, v)
+		return len(out) < 4
+	})
+	if fmt.Sprint(out) != "[-1 0 1 2]" {
+		t.Errorf("Expected [-1 0 1 2] but got %v", out)
+	}
+}
@@ -0,0 +1,518 @@
+package directive_test
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/dianelooney/directive"
+	"github.com/dianelooney/directive/ast"
+	"github.com/dianelooney/directive/eval"
+	"github.com/dianelooney/directive/format"
+)
+
+type oldSong struct {
+	Tempo float64
+	Kits  []*kit
+	Rest  []ast.Node `directive:",remain"`
+}
+
+func (s *oldSong) Kit() *kit {
+	k := &kit{}
+	s.Kits = append(s.Kits, k)
+	return k
+}
+
+const newerSong = `Tempo 120
+Swing 0.3
+Kit {
+	Volume 0.5
+	Reverb { Room "hall" }
+}
+[Marker "intro" "verse"]
+`
+
+func TestExecute_UnknownError(t *testing.T) {
+	err := directive.Execute([]byte(newerSong), &oldSong{})
+	if err == nil {
+		t.Errorf("Expected an error for the unknown directive Swing")
+	}
+}
+
+func TestExecute_UnknownSkip(t *testing.T) {
+	var warnings []string
+	s := oldSong{}
+	err := directive.Execute([]byte(newerSong), &s,
+		directive.UnknownDirectives(ast.UnknownSkip),
+		directive.Warnings(func(err error) { warnings = append(warnings, err.Error()) }))
+	if err != nil {
+		t.Fatalf("Execute returned an error: %v", err)
+	}
+
+	expected := []string{
+		"2:1: Swing: skipped unknown directive Swing for *directive_test.oldSong",
+		"5:2: Kit.Reverb: skipped unknown directive Reverb for *directive_test.kit",
+		"7:1: Marker: skipped unknown directive Marker for *directive_test.oldSong",
+	}
+	if len(warnings) != len(expected) {
+		t.Fatalf("Expected warnings %q but got %q", expected, warnings)
+	}
+	for i, w := range warnings {
+		if w != expected[i] {
+			t.Errorf("Expected warning %q but got %q", expected[i], w)
+		}
+	}
+	if s.Tempo != 120 || len(s.Kits) != 1 || s.Kits[0].Volume != 0.5 {
+		t.Errorf("Expected known directives to be executed but got %+v", s)
+	}
+}
+
+type openSong struct {
+	Tempo float64
+	Kit   openKit
+	Rest  []ast.Node `directive:",remain"`
+}
+
+type openKit struct {
+	Volume float64
+	Rest   []ast.Node `directive:",remain"`
+}
+
+func TestExecute_UnknownCollect(t *testing.T) {
+	s := openSong{}
+	err := directive.Execute([]byte(newerSong), &s, directive.UnknownDirectives(ast.UnknownCollect))
+	if err != nil {
+		t.Fatalf("Execute returned an error: %v", err)
+	}
+
+	if len(s.Rest) != 2 || len(s.Kit.Rest) != 1 {
+		t.Fatalf("Expected 2 collected directives and 1 in Kit but got %d and %d", len(s.Rest), len(s.Kit.Rest))
+	}
+	var buf bytes.Buffer
+	format.Prettify(s.Rest[1], &buf)
+	if buf.String() != "[Marker \"intro\" \"verse\"]\n" {
+		t.Errorf("Expected the collected directive to format back to its source but got %q", buf.String())
+	}
+	if d, ok := s.Kit.Rest[0].(*ast.Directive); !ok || d.Identifier != "Reverb" {
+		t.Errorf("Expected Kit to collect Reverb but got %v", s.Kit.Rest[0])
+	}
+
+	err = directive.Execute([]byte(newerSong), &oldSong{}, directive.UnknownDirectives(ast.UnknownCollect))
+	const expected = "5:2: Kit.Reverb: unknown directive Reverb for *directive_test.kit, which has no field tagged `directive:\",remain\"` to collect it"
+	if err == nil || err.Error() != expected {
+		t.Errorf("Expected error %q but got %v", expected, err)
+	}
+}
+
+type mix struct {
+	Tempo  float64
+	Name   string    `duplicate:"first"`
+	Pulses []float64 `directive:"Pulse"`
+}
+
+func TestExecute_Duplicates(t *testing.T) {
+	const doc = "Tempo 120\nName \"a\"\nName \"b\"\n[Pulse 1 2]\nTempo 90\n[Pulse 3]\n"
+
+	m := mix{}
+	err := directive.Execute([]byte(doc), &m)
+	if err != nil {
+		t.Fatalf("Execute returned an error: %v", err)
+	}
+	if m.Tempo != 90 || m.Name != "a" || len(m.Pulses) != 3 {
+		t.Errorf("Expected last Tempo, first Name and all pulses but got %+v", m)
+	}
+
+	m = mix{}
+	err = directive.Execute([]byte(doc), &m, directive.Duplicates(ast.DuplicateLast))
+	if err != nil {
+		t.Fatalf("Execute returned an error: %v", err)
+	}
+	if len(m.Pulses) != 1 || m.Pulses[0] != 3 {
+		t.Errorf("Expected only the last pulses but got %v", m.Pulses)
+	}
+
+	err = directive.Execute([]byte(doc), &mix{}, directive.Duplicates(ast.DuplicateError))
+	const expected = "5:1: Tempo[1]: Tempo is set more than once; first set at 1:1"
+	if err == nil || err.Error() != expected {
+		t.Errorf("Expected error %q but got %v", expected, err)
+	}
+
+	m = mix{}
+	err = directive.Execute([]byte(`[Tempo 1 2] [Name "a" "b"]`), &m)
+	if err != nil {
+		t.Fatalf("Execute returned an error: %v", err)
+	}
+	if m.Tempo != 2 || m.Name != "a" {
+		t.Errorf("Expected last Tempo and first Name of repeated values but got %+v", m)
+	}
+	err = directive.Execute([]byte(`[Tempo 1 2]`), &mix{}, directive.Duplicates(ast.DuplicateError))
+	const repeated = "1:10: Tempo[1]: Tempo is set more than once; first set at 1:8"
+	if err == nil || err.Error() != repeated {
+		t.Errorf("Expected error %q but got %v", repeated, err)
+	}
+}
+
+func TestValidate_Duplicates(t *testing.T) {
+	err := directive.Validate([]byte("Tempo 1\nTempo 2\nName \"a\"\n[Name \"b\" \"c\"]\n"), reflect.TypeOf(&mix{}))
+	const expected = "2:1: Tempo[1]: Tempo is set more than once; first set at 1:1"
+	if err == nil || err.Error() != expected {
+		t.Errorf("Expected error %q but got %v", expected, err)
+	}
+}
+
+func TestExecute_Atomic(t *testing.T) {
+	s := song{Tempo: 90, Kits: []*kit{{Volume: 0.2}}}
+	err := directive.Execute([]byte("Tempo 120\nKit { Volume 1 }\nKit { Volume 0.5 }\nTempo \"fast\"\n"), &s, directive.Atomic())
+	if err == nil {
+		t.Fatalf("Expected an error for Tempo \"fast\"")
+	}
+	if s.Tempo != 90 || len(s.Kits) != 1 || s.Kits[0].Volume != 0.2 {
+		t.Errorf("Expected the song to be untouched but got %+v", s)
+	}
+
+	err = directive.Execute([]byte("Tempo 120\nKit { Volume 1 }\n"), &s, directive.Atomic())
+	if err != nil {
+		t.Fatalf("Execute returned an error: %v", err)
+	}
+	if s.Tempo != 120 || len(s.Kits) != 2 || s.Kits[1].Volume != 1 {
+		t.Errorf("Expected the changes to be applied but got %+v", s)
+	}
+}
+
+type deck struct {
+	Tempo  float64
+	Tracks []*track
+	begun  map[string]int
+}
+
+type track struct {
+	Volume float64
+	Deck   *deck
+}
+
+func (d *deck) Track() *track {
+	t := &track{Deck: d}
+	d.Tracks = append(d.Tracks, t)
+	return t
+}
+
+func (d *deck) BeginDirective(name string) { d.begun[name]++ }
+
+func TestExecute_AtomicPointers(t *testing.T) {
+	d := deck{begun: map[string]int{}}
+	if err := directive.Execute([]byte("Tempo 120\nTrack { Volume 1 }\n"), &d, directive.Atomic()); err != nil {
+		t.Fatalf("Execute returned an error: %v", err)
+	}
+	if len(d.Tracks) != 1 || d.Tracks[0].Deck != &d {
+		t.Errorf("Expected the track to point at the deck but got %+v", d.Tracks)
+	}
+
+	// Unexported state is shared with the staging copy.
+	if err := directive.Execute([]byte("Tempo \"fast\"\n"), &d, directive.Atomic()); err == nil {
+		t.Fatalf("Expected an error for Tempo \"fast\"")
+	}
+	if d.Tempo != 120 || d.begun["Tempo"] != 2 {
+		t.Errorf("Expected tempo 120 and Tempo begun twice but got %v and %v", d.Tempo, d.begun)
+	}
+}
+
+func TestExecute_Concurrent(t *testing.T) {
+	e, err := directive.Prepare([]byte(benchSong))
+	if err != nil {
+		t.Fatalf("Prepare returned an error: %v", err)
+	}
+
+	want := song{}
+	if err := e.Execute(&want); err != nil {
+		t.Fatalf("Execute returned an error: %v", err)
+	}
+
+	var wg sync.WaitGroup
+	errs := make(chan error, 16)
+	for i := 0; i < 8; i++ {
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			s := song{}
+			if err := e.Execute(&s); err != nil {
+				errs <- err
+				return
+			}
+			if len(s.Kits) != 2 || fmt.Sprint(s.Kits[0].Pulses) != fmt.Sprint(want.Kits[0].Pulses) {
+				errs <- fmt.Errorf("unexpected song %+v", s)
+			}
+		}()
+		go func() {
+			defer wg.Done()
+			var v interface{}
+			if err := e.Execute(&v); err != nil {
+				errs <- err
+			}
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Error(err)
+	}
+}
+
+func TestExecute_Logger(t *testing.T) {
+	buf := &bytes.Buffer{}
+	l := slog.New(slog.NewTextHandler(buf, &slog.HandlerOptions{Level: slog.LevelDebug}))
+	err := directive.Execute([]byte("Tempo 120\nKit { Volume 0.5 }\n"), &song{}, directive.Logger(l))
+	if err != nil {
+		t.Fatalf("Execute returned an error: %v", err)
+	}
+
+	for _, s := range []string{"path=Tempo", "path=Kit", "path=Kit.Volume member=directive_test.kit.Volume value=0.5"} {
+		if !strings.Contains(buf.String(), s) {
+			t.Errorf("Expected the log to contain %q but got:\n%s", s, buf)
+		}
+	}
+}
+
+type tree struct {
+	Value  float64
+	Values []float64
+	Child  *tree
+}
+
+func TestExecuteContext_Limits(t *testing.T) {
+	cases := []struct {
+		doc    string
+		limits ast.Limits
+		limit  ast.Limit
+	}{
+		{"Child { Value 1 }\n", ast.Limits{}, ""},
+		{"Child { Value 1 }\n", ast.Limits{MaxDepth: 1}, ""},
+		{"Child { Child { Value 1 } }\n", ast.Limits{MaxDepth: 1}, ast.LimitDepth},
+		{"Value 1\nChild { }\n", ast.Limits{MaxNodes: 1}, ast.LimitNodes},
+		{"[Values 1 2 3]\n", ast.Limits{MaxSets: 2}, ast.LimitSets},
+		{"[Values `0 * 100000000`]\n", ast.Limits{MaxMacroLength: 1000}, ast.LimitMacroLength},
+	}
+	for _, c := range cases {
+		for _, target := range []interface{}{&tree{}, new(interface{})} {
+			err := directive.Execute([]byte(c.doc), target, directive.Limits(c.limits))
+			var lerr *ast.LimitError
+			if c.limit == "" && err != nil {
+				t.Errorf("%q into %T: Execute returned an error: %v", c.doc, target, err)
+			}
+			if c.limit != "" && (!errors.As(err, &lerr) || lerr.Limit != c.limit) {
+				t.Errorf("%q into %T: expected a %s limit error but got %v", c.doc, target, c.limit, err)
+			}
+		}
+	}
+}
+
+func TestExecuteContext_Canceled(t *testing.T) {
+	e, err := directive.Prepare([]byte(benchSong))
+	if err != nil {
+		t.Fatalf("Prepare returned an error: %v", err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	for _, target := range []interface{}{&song{}, new(interface{})} {
+		if err := e.ExecuteContext(ctx, target); !errors.Is(err, context.Canceled) {
+			t.Errorf("Expected context.Canceled for %T but got %v", target, err)
+		}
+	}
+}
+
+func TestExecuteContext_MacroDeadline(t *testing.T) {
+	e, err := directive.Prepare([]byte("Tempo 120\nKit { [Pulse `0 * 20000000`] }\n"))
+	if err != nil {
+		t.Fatalf("Prepare returned an error: %v", err)
+	}
+
+	for _, target := range []interface{}{&song{}, new(interface{})} {
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+		err := e.ExecuteContext(ctx, target)
+		cancel()
+		if !errors.Is(err, context.DeadlineExceeded) {
+			t.Errorf("Expected context.DeadlineExceeded for %T but got %v", target, err)
+		}
+	}
+}
+
+func TestExecute_AllErrors(t *testing.T) {
+	s := song{}
+	err := directive.Execute([]byte("Tempo \"fast\"\nKit {\n\tVolume \"loud\"\n\t[Pulse 1 \"x\" 3]\n}\nKit { Volume 0.5 }\n"), &s, directive.AllErrors())
+
+	const expected = "1:7: Tempo: error while setting field Tempo to 'fast': strconv.ParseFloat: parsing \"fast\": invalid syntax\n" +
+		"3:9: Kit[0].Volume: error while setting field Volume to 'loud': strconv.ParseFloat: parsing \"loud\": invalid syntax\n" +
+		"4:11: Kit[0].Pulse[1]: error while calling method Pulse with 'x': strconv.ParseFloat: parsing \"x\": invalid syntax"
+	if err == nil || err.Error() != expected {
+		t.Fatalf("Expected error:\n%s\nbut got:\n%v", expected, err)
+	}
+	var errs ast.Errors
+	if !errors.As(err, &errs) || len(errs) != 3 {
+		t.Fatalf("Expected 3 ast.Errors but got %#v", err)
+	}
+	var numErr *strconv.NumError
+	if !errors.As(err, &numErr) {
+		t.Errorf("Expected errors.As to find the *strconv.NumError")
+	}
+	if len(s.Kits) != 2 || fmt.Sprint(s.Kits[0].Pulses) != "[1 3]" || s.Kits[1].Volume != 0.5 {
+		t.Errorf("Expected execution to continue past the errors but got %+v", s)
+	}
+}
+
+func TestExecute_AllErrorsFatal(t *testing.T) {
+	err := directive.Execute([]byte("Tempo \"fast\"\nKit { Volume 1 }\nKit { Volume 0.5 }\n"), &song{},
+		directive.AllErrors(), directive.Limits(ast.Limits{MaxSets: 2}))
+
+	var errs ast.Errors
+	if !errors.As(err, &errs) || len(errs) != 2 {
+		t.Fatalf("Expected 2 ast.Errors but got %v", err)
+	}
+	if !strings.HasPrefix(errs[0].Error(), "1:7: Tempo: ") || errs[1].Error() != "3:14: Kit[1].Volume: set limit of 2 exceeded" {
+		t.Errorf("Expected the Tempo error followed by the limit error but got:\n%v", err)
+	}
+	var lerr *ast.LimitError
+	if !errors.As(err, &lerr) {
+		t.Errorf("Expected errors.As to find the *ast.LimitError")
+	}
+}
+
+func TestExecute_ErrorPositions(t *testing.T) {
+	doc := []byte("Tempo 120\nKit { Volume 1 }\nKit {\n\t[Pulse 1 2 \"x\"]\n}\n")
+	for _, target := range []interface{}{&song{}, &oldSong{}} {
+		err := directive.Execute(doc, target, directive.Filename("song.rave"))
+		const expected = "song.rave:4:13: Kit[1].Pulse[2]: error while calling method Pulse with 'x': "
+		if err == nil || !strings.HasPrefix(err.Error(), expected) {
+			t.Errorf("Expected an error starting with %q for %T but got %v", expected, target, err)
+		}
+		var xerr *ast.Error
+		if !errors.As(err, &xerr) || xerr.Pos.Line != 4 || xerr.Pos.Filename != "song.rave" {
+			t.Errorf("Expected an *ast.Error at line 4 of song.rave but got %#v", err)
+		}
+	}
+}
+
+func TestExecute_MacroError(t *testing.T) {
+	doc := []byte("Tempo 120\nKit { [Pulse 1 `0 % 1 0`] }\n")
+	const expected = "song.rave:2:19: Kit.Pulse[1]: column 3: % needs a modulus, min and max, got 2 values"
+	for _, target := range []interface{}{&song{}, new(interface{})} {
+		err := directive.Execute(doc, target, directive.Filename("song.rave"))
+		if err == nil || err.Error() != expected {
+			t.Errorf("Expected error %q for %T but got %v", expected, target, err)
+		}
+	}
+}
+
+func TestExecute_Macros(t *testing.T) {
+	r := eval.NewRegistry()
+	r.RegisterFunction("twice", func(args ...[]float64) ([]float64, error) {
+		return append(args[0], args[0]...), nil
+	})
+	doc := []byte("Tempo 120\nKit { [Pulse `twice(0 1)`] }\n")
+
+	var s song
+	if err := directive.Execute(doc, &s, directive.Macros(r)); err != nil {
+		t.Fatal(err)
+	}
+	if fmt.Sprint(s.Kits[0].Pulses) != "[0 1 0 1]" {
+		t.Errorf("Expected the macro to use the registry but got %v", s.Kits[0].Pulses)
+	}
+	if err := directive.Validate(doc, reflect.TypeOf(&song{}), directive.Macros(r)); err != nil {
+		t.Errorf("Validate returned an error: %v", err)
+	}
+	if err := directive.Execute(doc, &song{}); err == nil {
+		t.Errorf("Expected twice to be unknown without the registry")
+	}
+}
+
+func TestExecute_MacroFunctions(t *testing.T) {
+	var s song
+	err := directive.Execute([]byte("Tempo 120\nKit { [Pulse `euclid(5, 16)`] }\n"), &s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fmt.Sprint(s.Kits[0].Pulses) != "[0 3 6 9 12]" {
+		t.Errorf("Expected the euclidean pulses but got %v", s.Kits[0].Pulses)
+	}
+}
+
+func TestExecute_Seed(t *testing.T) {
+	const body = "Tempo 120\nKit { [Pulse `0..15 : x * chance(0.5)`] }\nKit { [Pulse `0..15 : x * chance(0.5)`] }\n"
+	pulses := func(doc string, opts ...directive.Option) string {
+		var s song
+		if err := directive.Execute([]byte(doc), &s, opts...); err != nil {
+			t.Fatal(err)
+		}
+		return fmt.Sprint(s.Kits[0].Pulses, s.Kits[1].Pulses)
+	}
+
+	a := pulses(body, directive.Seed(1))
+	if a != pulses(body, directive.Seed(1)) {
+		t.Errorf("Expected the same seed to render the same pulses")
+	}
+	if a == pulses(body, directive.Seed(2)) {
+		t.Errorf("Expected another seed to render other pulses")
+	}
+	if pulses("Seed 1\n"+body) != a || pulses("Seed 1\n"+body, directive.Seed(2)) != a {
+		t.Errorf("Expected the Seed directive to seed the document")
+	}
+	if pulses("Title \"carrot\"\n"+body, directive.Seed(1)) != a {
+		t.Errorf("Expected another directive to keep the seeds of the macros")
+	}
+
+	// An inserted Kit shifts the indexes of the others, and so their seeds.
+	var shifted song
+	doc := "Tempo 120\nKit { [Pulse 1] }\n" + strings.TrimPrefix(body, "Tempo 120\n")
+	if err := directive.Execute([]byte(doc), &shifted, directive.Seed(1)); err != nil {
+		t.Fatal(err)
+	}
+	if fmt.Sprint(shifted.Kits[1].Pulses, shifted.Kits[2].Pulses) == a {
+		t.Errorf("Expected an inserted Kit to reseed the macros after it")
+	}
+
+	var m map[string]interface{}
+	if err := directive.Execute([]byte("Seed 1\n"+body), &m); err != nil {
+		t.Fatal(err)
+	}
+	if m["Seed"] != 1.0 {
+		t.Errorf("Expected generic targets to keep the seed, got %v", m["Seed"])
+	}
+	if err := directive.Validate([]byte("Seed 1\n"+body), reflect.TypeOf(&song{})); err != nil {
+		t.Errorf("Validate returned an error: %v", err)
+	}
+
+	const expected = "1:6: Seed: Seed needs a whole number of at least 0, got -1"
+	if err := directive.Execute([]byte("Seed -1\n"+body), &song{}); err == nil || err.Error() != expected {
+		t.Errorf("Expected error %q but got %v", expected, err)
+	}
+}
+
+func TestExecute_Exact(t *testing.T) {
+	doc := []byte("Tempo 120\nKit { [Pulse `0 % 0.33 0 1`] }\n")
+	var s song
+	if err := directive.Execute(doc, &s, directive.Exact()); err != nil {
+		t.Fatal(err)
+	}
+	if fmt.Sprint(s.Kits[0].Pulses) != "[0 0.33 0.66 0.99]" {
+		t.Errorf("Expected exact pulses but got %v", s.Kits[0].Pulses)
+	}
+}
+
+func TestExecute_MacroStream(t *testing.T) {
+	var s song
+	err := directive.Execute([]byte("Tempo 120\nKit { [Pulse `0 * 100000000`] }\n"), &s, directive.Limits(ast.Limits{MaxSets: 100}))
+	var lerr *ast.LimitError
+	if !errors.As(err, &lerr) || lerr.Limit != ast.LimitSets {
+		t.Fatalf("Expected the set limit to stop the macro, got %v", err)
+	}
+	if len(s.Kits[0].Pulses) != 99 {
+		t.Errorf("Expected the values before the limit to be set, got %d", len(s.Kits[0].Pulses))
+	}
+}
@@ -32,16 +32,16 @@ func print(w *tabwriter.Writer, n ast.Node, i int) {
 	case *ast.Directive:
 		if _, ok := v.Value.(*ast.Object); ok {
 			if v.HasSemi {
-				w.Write([]byte(indent + v.Identifier + "\t{"))
+				w.Write([]byte(indent + identifier(v) + "\t{"))
 				printSingle(w, v.Value, i)
 				w.Write([]byte("};\n"))
 			} else {
-				w.Write([]byte(indent + v.Identifier + "\t{\n"))
+				w.Write([]byte(indent + identifier(v) + "\t{\n"))
 				print(w, v.Value, i)
 				w.Write([]byte(indent + "}\n"))
 			}
 		} else {
-			w.Write([]byte(indent + v.Identifier + "\t" + v.Value.Text() + "\n"))
+			w.Write([]byte(indent + identifier(v) + "\t" + v.Value.Text() + "\n"))
 		}
 	case *ast.RepeatedDirective:
 		s := indent + "[" + v.Identifier
@@ -69,12 +69,12 @@ func printSingle(w *tabwriter.Writer, n ast.Node, i int) {
 	case *ast.Directive:
 		if _, ok := v.Value.(*ast.Object); ok {
 			if v.HasSemi {
-				w.Write([]byte(v.Identifier + " {"))
+				w.Write([]byte(identifier(v) + " {"))
 				printSingle(w, v.Value, i)
 				w.Write([]byte("}"))
 			}
 		} else {
-			w.Write([]byte(" " + v.Identifier + "\t" + v.Value.Text() + " "))
+			w.Write([]byte(" " + identifier(v) + "\t" + v.Value.Text() + " "))
 		}
 	case *ast.RepeatedDirective:
 		s := indent + "[" + v.Identifier
@@ -93,3 +93,10 @@ func printSingle(w *tabwriter.Writer, n ast.Node, i int) {
 		}
 	}
 }
+
+func identifier(d *ast.Directive) string {
+	if d.Label == "" {
+		return d.Identifier
+	}
+	return d.Identifier + " " + d.Label
+}
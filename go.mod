@@ -1 +1,3 @@
 module github.com/dianelooney/directive
+
+go 1.23
@@ -0,0 +1,132 @@
+package directive
+
+import (
+	"log/slog"
+
+	"github.com/dianelooney/directive/ast"
+	"github.com/dianelooney/directive/eval"
+)
+
+// Option configures Prepare, Execute and the generic decoders.
+type Option func(*config)
+
+type config struct {
+	useNumber bool
+	filename  string
+	exec      ast.Options
+}
+
+func newConfig(opts []Option) *config {
+	c := &config{}
+	for _, o := range opts {
+		o(c)
+	}
+	return c
+}
+
+func (c *config) parse(data []byte) (ast.Node, error) {
+	if c.filename != "" {
+		return ast.NewFileParser(c.filename, data).Parse()
+	}
+	return ast.NewParser(data).Parse()
+}
+
+// Filename names the file data was read from. Positions in errors then
+// render as "file:line:col", the way compilers report them.
+func Filename(name string) Option {
+	return func(c *config) {
+		c.filename = name
+	}
+}
+
+// UseNumber makes the generic decoders keep number literals as json.Number
+// instead of converting them to float64.
+func UseNumber() Option {
+	return func(c *config) {
+		c.useNumber = true
+	}
+}
+
+// UnknownDirectives sets what Execute does with directives the target has
+// no method or field for: fail (ast.UnknownError, the default), skip them
+// (ast.UnknownSkip) or keep them in a field tagged `directive:",remain"`
+// (ast.UnknownCollect), failing where there is no such field.
+func UnknownDirectives(p ast.UnknownPolicy) Option {
+	return func(c *config) {
+		c.exec.Unknown = p
+	}
+}
+
+// Warnings sets a function that is called for every directive Execute
+// skipped.
+func Warnings(fn func(err error)) Option {
+	return func(c *config) {
+		c.exec.Warn = fn
+	}
+}
+
+// Duplicates sets what Execute does when a scope sets the same field more
+// than once, for fields without a `duplicate` tag. See ast.DuplicatePolicy.
+func Duplicates(p ast.DuplicatePolicy) Option {
+	return func(c *config) {
+		c.exec.Duplicates = p
+	}
+}
+
+// Atomic makes Execute run against a staging copy of the target and apply
+// the changes only if the whole document succeeds. Unexported state is not
+// copied. See ast.Options.Atomic.
+func Atomic() Option {
+	return func(c *config) {
+		c.exec.Atomic = true
+	}
+}
+
+// Logger makes Execute trace every value it sets and every block it enters
+// to l at debug level, and log values it ignores as warnings.
+func Logger(l *slog.Logger) Option {
+	return func(c *config) {
+		c.exec.Logger = l
+	}
+}
+
+// Limits bounds the resources a single Execute may use. Exceeding a limit
+// fails with an *ast.LimitError.
+func Limits(l ast.Limits) Option {
+	return func(c *config) {
+		c.exec.Limits = l
+	}
+}
+
+// AllErrors makes Execute keep going past failing directives and return
+// all of their errors as ast.Errors. See ast.Options.AllErrors.
+func AllErrors() Option {
+	return func(c *config) {
+		c.exec.AllErrors = true
+	}
+}
+
+// Macros makes macros use the operators and functions of r instead of the
+// default eval registry.
+func Macros(r *eval.Registry) Option {
+	return func(c *config) {
+		c.exec.Macros = r
+	}
+}
+
+// Seed seeds the random functions of macros, such as rand and chance, for
+// documents that do not set their own seed with a Seed directive. See
+// ast.SeedDirective.
+func Seed(seed uint64) Option {
+	return func(c *config) {
+		c.exec.Seed = seed
+	}
+}
+
+// Exact makes macros compute with rational numbers, so that 1/3 stays
+// exactly a third until the value is set. See ast.Options.Exact.
+func Exact() Option {
+	return func(c *config) {
+		c.exec.Exact = true
+	}
+}
@@ -0,0 +1,14 @@
+package directive
+
+import "github.com/dianelooney/directive/ast"
+
+// Register makes name available as a block kind, so that a document can
+// create values of different concrete types for one interface-typed slice
+// or map field:
+//
+//	directive.Register("Wave", func() Instrument { return &Wave{} })
+//
+// See ast.Register for the exact rules.
+func Register(name string, factory interface{}) {
+	ast.Register(name, factory)
+}
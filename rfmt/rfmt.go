@@ -2,16 +2,28 @@ package main
 
 import (
 	"bytes"
+	"encoding/json"
+	"flag"
 	"fmt"
 	"io/ioutil"
 	"os"
+	"text/tabwriter"
 
+	"github.com/dianelooney/directive"
 	"github.com/dianelooney/directive/ast"
 	"github.com/dianelooney/directive/format"
 )
 
 func main() {
-	files := os.Args[1:]
+	if len(os.Args) > 1 && os.Args[1] == "plan" {
+		plan(os.Args[2:])
+		return
+	}
+
+	schema := flag.Bool("schema", false, "format schemas, which may use labels and bare words")
+	flag.Parse()
+
+	files := flag.Args()
 	for _, path := range files {
 		data, err := ioutil.ReadFile(path)
 		if err != nil {
@@ -19,6 +31,9 @@ func main() {
 			continue
 		}
 		p := ast.NewParser(data)
+		if *schema {
+			p = p.Labeled()
+		}
 		d, err := p.Parse()
 		if err != nil {
 			fmt.Printf("Unable to parse '%s': %v", path, err)
@@ -33,3 +48,49 @@ func main() {
 		}
 	}
 }
+
+// plan prints the operations executing each file into a generic map would
+// perform: rfmt plan [-json] file...
+func plan(args []string) {
+	flags := flag.NewFlagSet("plan", flag.ExitOnError)
+	asJSON := flags.Bool("json", false, "print the plan as JSON")
+	flags.Parse(args)
+
+	for _, path := range flags.Args() {
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			fmt.Printf("Error reading '%s': %v\n", path, err)
+			continue
+		}
+		e, err := directive.Prepare(data, directive.Filename(path))
+		if err != nil {
+			fmt.Printf("Unable to parse '%s': %v\n", path, err)
+			continue
+		}
+
+		var target interface{}
+		ops, err := e.Plan(&target)
+		if err != nil {
+			fmt.Printf("Unable to plan '%s': %v\n", path, err)
+			continue
+		}
+
+		if *asJSON {
+			enc := json.NewEncoder(os.Stdout)
+			enc.SetIndent("", "  ")
+			enc.Encode(ops)
+			continue
+		}
+
+		w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+		fmt.Fprintln(w, "POSITION\tPATH\tOP\tMEMBER\tVALUE")
+		for _, op := range ops {
+			value := ""
+			if op.Value != nil {
+				value = fmt.Sprintf("%#v", op.Value)
+			}
+			fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\n", op.Pos, op.Path, op.Kind, op.Member, value)
+		}
+		w.Flush()
+	}
+}
@@ -0,0 +1,87 @@
+package schema
+
+import "encoding/json"
+
+// JSONSchema returns s as a JSON Schema (draft 2020-12) describing the
+// output of directive.DecodeMap for documents that satisfy s.
+func (s *Schema) JSONSchema() map[string]interface{} {
+	out := s.Block.jsonSchema()
+	out["$schema"] = "https://json-schema.org/draft/2020-12/schema"
+	return out
+}
+
+// MarshalJSON encodes s as a JSON Schema.
+func (s *Schema) MarshalJSON() ([]byte, error) {
+	return json.Marshal(s.JSONSchema())
+}
+
+func (b *Block) jsonSchema() map[string]interface{} {
+	props := map[string]interface{}{}
+	required := []string{}
+	for _, d := range b.Directives {
+		props[d.Name] = repeated(d.jsonSchema(), d.Repeated)
+		if d.Required {
+			required = append(required, d.Name)
+		}
+	}
+	for _, c := range b.Blocks {
+		props[c.Name] = repeated(c.jsonSchema(), c.Repeated)
+		if c.Required {
+			required = append(required, c.Name)
+		}
+	}
+
+	out := map[string]interface{}{
+		"type":                 "object",
+		"properties":           props,
+		"additionalProperties": b.Open,
+	}
+	if len(required) > 0 {
+		out["required"] = required
+	}
+	if b.Description != "" {
+		out["description"] = b.Description
+	}
+	return out
+}
+
+func (d *Directive) jsonSchema() map[string]interface{} {
+	out := map[string]interface{}{}
+	switch d.Type {
+	case String:
+		out["type"] = "string"
+	case Number:
+		out["type"] = "number"
+	case Integer:
+		out["type"] = "integer"
+	case Note:
+		out["type"] = []string{"string", "integer"}
+	}
+	if d.Min != nil {
+		out["minimum"] = *d.Min
+	}
+	if d.Max != nil {
+		out["maximum"] = *d.Max
+	}
+	if len(d.Enum) > 0 {
+		out["enum"] = d.Enum
+	}
+	if d.Description != "" {
+		out["description"] = d.Description
+	}
+	return out
+}
+
+// repeated describes the value of a Repeated definition, which
+// DecodeMap returns as a single item when it occurs once and as an array
+// otherwise. It is anyOf rather than oneOf, as an item of type any is an
+// array too.
+func repeated(item map[string]interface{}, ok bool) map[string]interface{} {
+	if !ok {
+		return item
+	}
+	return map[string]interface{}{"anyOf": []interface{}{
+		item,
+		map[string]interface{}{"type": "array", "items": item},
+	}}
+}
@@ -0,0 +1,232 @@
+// Package schema describes the shape of a directive document in the
+// directive language itself, so documents can be checked without a Go
+// target type:
+//
+//	Directive Tempo { Type number; Min 20; Max 300; Required true }
+//	Block Kit {
+//		Repeated true
+//		Directive Sample { Type string }
+//		Directive Pulse { Type number; Repeated true }
+//	}
+//
+// Besides the usual directive syntax, schemas name their definitions with
+// a label after Directive or Block, and may write words such as true or
+// number without quotes.
+//
+// A Directive describes a scalar directive and takes the properties Type
+// (one of string, number, integer, note or any), Min, Max, [Enum ...],
+// Required, Repeated and Description. A Block describes an object directive
+// and takes Required, Repeated, Open (allow undeclared directives),
+// Description and nested Directive and Block definitions. The top level of
+// a schema is itself a block.
+package schema
+
+import (
+	"fmt"
+	"strconv"
+
+	"github.com/dianelooney/directive/ast"
+)
+
+// Type is the kind of value a Directive accepts.
+type Type string
+
+const (
+	Any     Type = "any"
+	String  Type = "string"
+	Number  Type = "number"
+	Integer Type = "integer"
+	Note    Type = "note"
+)
+
+// Directive describes a directive with a scalar value.
+type Directive struct {
+	Name        string
+	Description string
+	Type        Type
+	Min         *float64
+	Max         *float64
+	Enum        []string
+	Required    bool
+	Repeated    bool
+	Pos         ast.Position
+}
+
+// Block describes an object directive, or the whole document.
+type Block struct {
+	Name        string
+	Description string
+	Required    bool
+	Repeated    bool
+	Open        bool
+	Directives  []*Directive
+	Blocks      []*Block
+	Pos         ast.Position
+}
+
+// Schema is the root block of a parsed schema.
+type Schema struct {
+	Block
+}
+
+func (b *Block) directive(name string) *Directive {
+	for _, d := range b.Directives {
+		if d.Name == name {
+			return d
+		}
+	}
+	return nil
+}
+
+func (b *Block) block(name string) *Block {
+	for _, c := range b.Blocks {
+		if c.Name == name {
+			return c
+		}
+	}
+	return nil
+}
+
+func (b *Block) names() (out []string) {
+	for _, d := range b.Directives {
+		out = append(out, d.Name)
+	}
+	for _, c := range b.Blocks {
+		out = append(out, c.Name)
+	}
+	return out
+}
+
+// Parse reads a schema. Mistakes in the schema itself are returned as
+// ast.Diagnostics.
+func Parse(data []byte) (*Schema, error) {
+	doc, err := ast.NewParser(data).Labeled().Parse()
+	if err != nil {
+		return nil, err
+	}
+
+	p := parser{}
+	s := &Schema{}
+	s.Pos = doc.Begin()
+	p.block(&s.Block, doc.(*ast.Document).Directives, true)
+	if p.diags != nil {
+		return nil, p.diags
+	}
+	return s, nil
+}
+
+type parser struct {
+	diags ast.Diagnostics
+}
+
+func (p *parser) report(n ast.Node, format string, args ...interface{}) {
+	p.diags = append(p.diags, ast.Diagnostic{Pos: n.Begin(), Message: fmt.Sprintf(format, args...)})
+}
+
+func (p *parser) block(b *Block, dirs []ast.Node, root bool) {
+	for _, n := range dirs {
+		switch d := n.(type) {
+		case *ast.Directive:
+			o, isObject := d.Value.(*ast.Object)
+			switch {
+			case d.Identifier == "Directive" && isObject && d.Label != "":
+				if b.directive(d.Label) != nil || b.block(d.Label) != nil {
+					p.report(d, "%s is defined more than once", d.Label)
+				}
+				b.Directives = append(b.Directives, p.directive(d.Label, d, o))
+			case d.Identifier == "Block" && isObject && d.Label != "":
+				if b.directive(d.Label) != nil || b.block(d.Label) != nil {
+					p.report(d, "%s is defined more than once", d.Label)
+				}
+				c := &Block{Name: d.Label, Pos: d.Begin()}
+				p.block(c, o.Directives, false)
+				b.Blocks = append(b.Blocks, c)
+			case d.Identifier == "Directive" || d.Identifier == "Block":
+				p.report(d, "%s needs a name and a block, as in `%s Name { ... }`", d.Identifier, d.Identifier)
+			case d.Identifier == "Description":
+				b.Description = p.str(d.Value)
+			case d.Identifier == "Open":
+				b.Open = p.bool(d.Value)
+			case d.Identifier == "Required" && !root:
+				b.Required = p.bool(d.Value)
+			case d.Identifier == "Repeated" && !root:
+				b.Repeated = p.bool(d.Value)
+			default:
+				p.report(d, "unknown block property %s", d.Identifier)
+			}
+		case *ast.RepeatedDirective:
+			p.report(d, "unknown block property %s", d.Identifier)
+		}
+	}
+}
+
+func (p *parser) directive(name string, n ast.Node, o *ast.Object) *Directive {
+	d := &Directive{Name: name, Type: Any, Pos: n.Begin()}
+	for _, n := range o.Directives {
+		switch v := n.(type) {
+		case *ast.Directive:
+			switch v.Identifier {
+			case "Type":
+				d.Type = Type(p.str(v.Value))
+				switch d.Type {
+				case Any, String, Number, Integer, Note:
+				default:
+					p.report(v.Value, "unknown type %q, expected any, string, number, integer or note", d.Type)
+				}
+			case "Min":
+				d.Min = p.float(v.Value)
+			case "Max":
+				d.Max = p.float(v.Value)
+			case "Enum":
+				d.Enum = append(d.Enum, p.str(v.Value))
+			case "Required":
+				d.Required = p.bool(v.Value)
+			case "Repeated":
+				d.Repeated = p.bool(v.Value)
+			case "Description":
+				d.Description = p.str(v.Value)
+			default:
+				p.report(v, "unknown directive property %s", v.Identifier)
+			}
+		case *ast.RepeatedDirective:
+			if v.Identifier != "Enum" {
+				p.report(v, "unknown directive property %s", v.Identifier)
+				continue
+			}
+			for _, value := range v.Values {
+				d.Enum = append(d.Enum, p.str(value))
+			}
+		}
+	}
+	return d
+}
+
+func (p *parser) str(n ast.Node) string {
+	switch v := n.(type) {
+	case *ast.String:
+		return v.Value
+	case *ast.Number:
+		return v.Value
+	case *ast.Note:
+		return v.Value
+	}
+	p.report(n, "expected a value, got %s", n.Text())
+	return ""
+}
+
+func (p *parser) bool(n ast.Node) bool {
+	b, err := strconv.ParseBool(p.str(n))
+	if err != nil {
+		p.report(n, "expected true or false, got %s", n.Text())
+	}
+	return b
+}
+
+func (p *parser) float(n ast.Node) *float64 {
+	f, err := strconv.ParseFloat(p.str(n), 64)
+	if err != nil {
+		p.report(n, "expected a number, got %s", n.Text())
+		return nil
+	}
+	return &f
+}
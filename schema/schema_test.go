@@ -0,0 +1,109 @@
+package schema_test
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/dianelooney/directive/ast"
+	"github.com/dianelooney/directive/schema"
+)
+
+const songSchema = `
+Directive Tempo { Type number; Min 20; Max 300; Required true }
+Directive Name { Type "string" }
+Block Kit {
+	Repeated true
+	Directive Volume { Type number; Min 0; Max 1 }
+	Directive Pattern { [Enum sin "square" saw] }
+	Directive Pulse { Type "number"; Repeated "true" }
+}
+`
+
+func TestValidate(t *testing.T) {
+	s, err := schema.Parse([]byte(songSchema))
+	if err != nil {
+		t.Fatalf("Parse returned an error: %v", err)
+	}
+
+	const doc = `Name "carrot"
+Name 12
+Kit {
+	Volume 1.5
+	Pattern "triangle"
+	[Pulse 1 2 3]
+	Sampel "x"
+}
+`
+	err = s.Validate([]byte(doc))
+	diags, ok := err.(ast.Diagnostics)
+	if !ok {
+		t.Fatalf("Expected ast.Diagnostics but got %v", err)
+	}
+
+	expected := []string{
+		"1:1: missing required directive Tempo",
+		"2:1: Name[1]: Name is set more than once; first set at 1:1",
+		"2:6: Name[1]: Name expects a string, not the number 12",
+		"4:9: Kit.Volume: Volume must be at most 1, not 1.5",
+		`5:10: Kit.Pattern: Pattern must be one of sin, square, saw, not "triangle"`,
+		"7:2: Kit.Sampel: unknown directive Sampel",
+	}
+	if len(diags) != len(expected) {
+		t.Fatalf("Expected %d diagnostics but got %d:\n%v", len(expected), len(diags), diags)
+	}
+	for i, d := range diags {
+		if d.Error() != expected[i] {
+			t.Errorf("Expected diagnostic %q but got %q", expected[i], d.Error())
+		}
+	}
+
+	err = s.Validate([]byte(`Tempo 120 Kit { Volume 0.5 } Kit { [Pulse 1 2] }`))
+	if err != nil {
+		t.Errorf("Validate returned an error for a valid document: %v", err)
+	}
+}
+
+func TestValidate_Macros(t *testing.T) {
+	s, err := schema.Parse([]byte("Directive Count { Type integer; Min 1; Repeated true }"))
+	if err != nil {
+		t.Fatalf("Parse returned an error: %v", err)
+	}
+
+	cases := map[string]string{
+		"[Count `1 2 3`]":     "",
+		"[Count `1 1.5`]":     "1:8: Count: Count expects a integer, not 1.5 from the macro `1 1.5`",
+		"[Count `0 % 1 0 4`]": "1:8: Count: Count must be at least 1, not 0 from the macro `0 % 1 0 4`",
+	}
+	for doc, expected := range cases {
+		err := s.Validate([]byte(doc))
+		if expected == "" && err != nil {
+			t.Errorf("%s: Validate returned an error: %v", doc, err)
+		}
+		if expected != "" && (err == nil || err.Error() != expected) {
+			t.Errorf("%s: expected error %q but got %v", doc, expected, err)
+		}
+	}
+}
+
+func TestParse_Errors(t *testing.T) {
+	_, err := schema.Parse([]byte(`Directive Tempo { Type "float" }` + "\n" + `Block { }`))
+	if err == nil || err.Error() != "1:24: unknown type \"float\", expected any, string, number, integer or note\n2:1: Block needs a name and a block, as in `Block Name { ... }`" {
+		t.Errorf("Unexpected error: %v", err)
+	}
+}
+
+func TestJSONSchema(t *testing.T) {
+	s, err := schema.Parse([]byte(songSchema))
+	if err != nil {
+		t.Fatalf("Parse returned an error: %v", err)
+	}
+
+	data, err := json.Marshal(s)
+	if err != nil {
+		t.Fatalf("json.Marshal returned an error: %v", err)
+	}
+	const expected = `{"$schema":"https://json-schema.org/draft/2020-12/schema","additionalProperties":false,"properties":{"Kit":{"anyOf":[{"additionalProperties":false,"properties":{"Pattern":{"enum":["sin","square","saw"]},"Pulse":{"anyOf":[{"type":"number"},{"items":{"type":"number"},"type":"array"}]},"Volume":{"maximum":1,"minimum":0,"type":"number"}},"type":"object"},{"items":{"additionalProperties":false,"properties":{"Pattern":{"enum":["sin","square","saw"]},"Pulse":{"anyOf":[{"type":"number"},{"items":{"type":"number"},"type":"array"}]},"Volume":{"maximum":1,"minimum":0,"type":"number"}},"type":"object"},"type":"array"}]},"Name":{"type":"string"},"Tempo":{"maximum":300,"minimum":20,"type":"number"}},"required":["Tempo"],"type":"object"}`
+	if string(data) != expected {
+		t.Errorf("Expected %s but got %s", expected, data)
+	}
+}
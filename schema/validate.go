@@ -0,0 +1,231 @@
+package schema
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/dianelooney/directive/ast"
+	"github.com/dianelooney/directive/eval"
+)
+
+// Validate parses data and checks it against s.
+func (s *Schema) Validate(data []byte) error {
+	doc, err := ast.NewParser(data).Parse()
+	if err != nil {
+		return err
+	}
+	if diags := s.ValidateNode(doc); diags != nil {
+		return diags
+	}
+	return nil
+}
+
+// ValidateNode checks a parsed document or object against s and returns
+// every problem found, or nil.
+func (s *Schema) ValidateNode(n ast.Node) ast.Diagnostics {
+	v := validator{}
+	switch d := n.(type) {
+	case *ast.Document:
+		v.block(&s.Block, d.Directives, "", d.Begin())
+	case *ast.Object:
+		v.block(&s.Block, d.Directives, "", d.Begin())
+	default:
+		v.report(n.Begin(), "", "cannot validate %T", n)
+	}
+	sort.SliceStable(v.diags, func(i, j int) bool {
+		return v.diags[i].Pos.Byte < v.diags[j].Pos.Byte
+	})
+	return v.diags
+}
+
+type validator struct {
+	diags ast.Diagnostics
+}
+
+func (v *validator) report(pos ast.Position, path string, format string, args ...interface{}) {
+	v.diags = append(v.diags, ast.Diagnostic{Pos: pos, Path: path, Message: fmt.Sprintf(format, args...)})
+}
+
+func (v *validator) block(b *Block, dirs []ast.Node, path string, pos ast.Position) {
+	paths := ast.NewBreadcrumbs(path, dirs)
+	first := map[string]ast.Position{}
+	for _, n := range dirs {
+		switch d := n.(type) {
+		case *ast.Directive:
+			p := paths.Next(d.Identifier)
+			if !v.once(b, d.Identifier, first, p, d.Begin()) {
+				continue
+			}
+			v.value(b, d.Identifier, d.Value, p)
+		case *ast.RepeatedDirective:
+			p := paths.Join(d.Identifier)
+			if !v.once(b, d.Identifier, first, p, d.Begin()) {
+				for range d.Values {
+					paths.Next(d.Identifier)
+				}
+				continue
+			}
+			if dd := b.directive(d.Identifier); dd != nil && !dd.Repeated {
+				v.report(d.Begin(), p, "%s takes a single value and cannot be repeated", d.Identifier)
+			} else if bb := b.block(d.Identifier); bb != nil && !bb.Repeated {
+				v.report(d.Begin(), p, "%s takes a single block and cannot be repeated", d.Identifier)
+			}
+			for _, value := range d.Values {
+				v.value(b, d.Identifier, value, paths.Next(d.Identifier))
+			}
+		}
+	}
+
+	for _, d := range b.Directives {
+		if _, ok := first[d.Name]; d.Required && !ok {
+			v.report(pos, path, "missing required directive %s", d.Name)
+		}
+	}
+	for _, c := range b.Blocks {
+		if _, ok := first[c.Name]; c.Required && !ok {
+			v.report(pos, path, "missing required block %s", c.Name)
+		}
+	}
+}
+
+// once records an occurrence of ident and reports whether its values
+// should be checked. Undeclared identifiers and duplicates of
+// non-repeated ones are reported here.
+func (v *validator) once(b *Block, ident string, first map[string]ast.Position, path string, pos ast.Position) bool {
+	d, c := b.directive(ident), b.block(ident)
+	if d == nil && c == nil {
+		if b.Open {
+			return false
+		}
+		if s := ast.Suggest(ident, b.names()); s != "" {
+			v.report(pos, path, "unknown directive %s; did you mean %s?", ident, s)
+		} else {
+			v.report(pos, path, "unknown directive %s", ident)
+		}
+		return false
+	}
+
+	prev, seen := first[ident]
+	if !seen {
+		first[ident] = pos
+		return true
+	}
+	if (d != nil && !d.Repeated) || (c != nil && !c.Repeated) {
+		v.report(pos, path, "%s is set more than once; first set at %s", ident, prev)
+	}
+	return true
+}
+
+func (v *validator) value(b *Block, ident string, n ast.Node, path string) {
+	if o, ok := n.(*ast.Object); ok {
+		c := b.block(ident)
+		if c == nil {
+			v.report(n.Begin(), path, "%s expects a value, not a block", ident)
+			return
+		}
+		v.block(c, o.Directives, path, o.Begin())
+		return
+	}
+
+	d := b.directive(ident)
+	if d == nil {
+		v.report(n.Begin(), path, "%s expects a block, not %s", ident, n.Text())
+		return
+	}
+	v.scalar(d, n, path)
+}
+
+func (v *validator) scalar(d *Directive, n ast.Node, path string) {
+	var value string
+	switch n := n.(type) {
+	case *ast.Unknown:
+		return
+	case *ast.String:
+		if n.IsMacro {
+			if d.Type != Any && d.Type != Number && d.Type != Integer {
+				v.report(n.Begin(), path, "%s expects a %s, not a macro", d.Name, d.Type)
+				return
+			}
+			v.macro(d, n, path)
+			return
+		}
+		if d.Type != Any && d.Type != String {
+			v.report(n.Begin(), path, "%s expects a %s, not the string %s", d.Name, d.Type, n.Text())
+			return
+		}
+		value = n.Value
+	case *ast.Number:
+		switch {
+		case d.Type == String:
+			v.report(n.Begin(), path, "%s expects a string, not the number %s", d.Name, n.Text())
+			return
+		case (d.Type == Integer || d.Type == Note) && strings.Contains(n.Value, "."):
+			v.report(n.Begin(), path, "%s expects a %s, not %s", d.Name, d.Type, n.Text())
+			return
+		}
+		value = n.Value
+	case *ast.Note:
+		if d.Type != Any && d.Type != Note {
+			v.report(n.Begin(), path, "%s expects a %s, not the note %s", d.Name, d.Type, n.Text())
+			return
+		}
+		value = n.Value
+	default:
+		return
+	}
+
+	if len(d.Enum) > 0 && !contains(d.Enum, value) {
+		v.report(n.Begin(), path, "%s must be one of %s, not %s", d.Name, strings.Join(d.Enum, ", "), n.Text())
+	}
+	if f, err := strconv.ParseFloat(value, 64); err == nil {
+		if d.Min != nil && f < *d.Min {
+			v.report(n.Begin(), path, "%s must be at least %v, not %s", d.Name, *d.Min, n.Text())
+		}
+		if d.Max != nil && f > *d.Max {
+			v.report(n.Begin(), path, "%s must be at most %v, not %s", d.Name, *d.Max, n.Text())
+		}
+	}
+}
+
+// macro evaluates the macro n and checks its values against d as if they
+// were written out, reporting the first that does not fit.
+func (v *validator) macro(d *Directive, n *ast.String, path string) {
+	expr, err := eval.Compile(n.Value)
+	if err != nil {
+		v.report(ast.MacroPos(n, err), path, "invalid macro %s: %v", n.Text(), err)
+		return
+	}
+	st := expr.Stream(0)
+	for f := range st.All() {
+		var problem string
+		switch {
+		case d.Type == Integer && f != math.Trunc(f):
+			problem = fmt.Sprintf("%s expects a %s", d.Name, d.Type)
+		case len(d.Enum) > 0 && !contains(d.Enum, fmt.Sprint(f)):
+			problem = fmt.Sprintf("%s must be one of %s", d.Name, strings.Join(d.Enum, ", "))
+		case d.Min != nil && f < *d.Min:
+			problem = fmt.Sprintf("%s must be at least %v", d.Name, *d.Min)
+		case d.Max != nil && f > *d.Max:
+			problem = fmt.Sprintf("%s must be at most %v", d.Name, *d.Max)
+		default:
+			continue
+		}
+		v.report(n.Begin(), path, "%s, not %v from the macro %s", problem, f, n.Text())
+		return
+	}
+	if err := st.Err(); err != nil {
+		v.report(ast.MacroPos(n, err), path, "invalid macro %s: %v", n.Text(), err)
+	}
+}
+
+func contains(list []string, s string) bool {
+	for _, l := range list {
+		if l == s {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,26 @@
+package directive
+
+import (
+	"reflect"
+
+	"github.com/dianelooney/directive/ast"
+)
+
+// Validate checks that data could be executed into a value of type t
+// without executing it. Problems are returned as ast.Diagnostics, each with
+// the position and path of the offending directive.
+//
+// Fields tagged `directive:",required"` must be present, and a tag name
+// replaces the field name as the directive identifier.
+func Validate(data []byte, t reflect.Type, opts ...Option) error {
+	c := newConfig(opts)
+	doc, err := c.parse(data)
+	if err != nil {
+		return err
+	}
+
+	if diags := ast.ValidateWith(doc, t, c.exec); diags != nil {
+		return diags
+	}
+	return nil
+}
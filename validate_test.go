@@ -0,0 +1,89 @@
+package directive_test
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/dianelooney/directive"
+	"github.com/dianelooney/directive/ast"
+)
+
+type song struct {
+	Tempo  float64 `directive:",required"`
+	Name   string  `directive:"Title"`
+	Sample []string
+	Kits   []*kit
+}
+
+func (s *song) Kit() *kit {
+	k := &kit{}
+	s.Kits = append(s.Kits, k)
+	return k
+}
+
+type kit struct {
+	Volume float64
+	Pulses []float64
+}
+
+func (k *kit) Pulse(t float64) {
+	k.Pulses = append(k.Pulses, t)
+}
+
+func TestValidate(t *testing.T) {
+	const doc = `Title "carrot"
+[Sample "808s_2" "hihats_1"]
+Kit {
+	Volum 0.5
+	[Pulse 1 "x" 3]
+}
+[Title "a" "b"]
+Kit { Volume { } }
+`
+
+	err := directive.Validate([]byte(doc), reflect.TypeOf(&song{}))
+	diags, ok := err.(ast.Diagnostics)
+	if !ok {
+		t.Fatalf("Expected ast.Diagnostics but got %v", err)
+	}
+
+	expected := []string{
+		"1:1: missing required directive Tempo",
+		"4:2: Kit[0].Volum: unknown directive Volum for *directive_test.kit; did you mean Volume?",
+		`5:11: Kit[0].Pulse[1]: cannot use "x" as float64 for Pulse`,
+		"7:1: Title: Title is set more than once; first set at 1:1",
+		"8:7: Kit[1].Volume: Volume expects a value, not a block",
+	}
+	if len(diags) != len(expected) {
+		t.Fatalf("Expected %d diagnostics but got %d:\n%v", len(expected), len(diags), diags)
+	}
+	for i, d := range diags {
+		if d.Error() != expected[i] {
+			t.Errorf("Expected diagnostic %q but got %q", expected[i], d.Error())
+		}
+	}
+}
+
+func TestValidate_Valid(t *testing.T) {
+	const doc = "Tempo 120 [Sample `0..2`] Kit { [Pulse 1 2] }"
+	err := directive.Validate([]byte(doc), reflect.TypeOf(&song{}))
+	if err != nil {
+		t.Errorf("Validate returned an error: %v", err)
+	}
+	if err := directive.Execute([]byte(doc), &song{}); err != nil {
+		t.Errorf("Execute returned an error: %v", err)
+	}
+}
+
+func TestValidate_Remain(t *testing.T) {
+	err := directive.Validate([]byte(newerSong), reflect.TypeOf(&oldSong{}), directive.UnknownDirectives(ast.UnknownCollect))
+	const expected = "5:2: Kit.Reverb: unknown directive Reverb for *directive_test.kit"
+	if err == nil || err.Error() != expected {
+		t.Errorf("Expected error %q but got %v", expected, err)
+	}
+
+	err = directive.Validate([]byte(newerSong), reflect.TypeOf(&oldSong{}))
+	if diags, ok := err.(ast.Diagnostics); !ok || len(diags) != 3 {
+		t.Errorf("Expected 3 unknown directives without UnknownCollect but got %v", err)
+	}
+}